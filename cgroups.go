@@ -0,0 +1,185 @@
+/*
+
+rtop - the remote system monitoring utility
+
+Copyright (c) 2015 RapidLoop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type CgroupInfo struct {
+	Path      string // relative to the root of the hierarchy
+	CPU       float64
+	MemUsage  uint64
+	MemLimit  uint64 // 0 if there is no limit
+	ReadRate  float64
+	WriteRate float64
+	Pids      uint64
+}
+
+// how deep to look for cgroups, e.g. system.slice/docker-123.scope is 2
+const cgroupDepth = 4
+
+// cgroupsCommand prints v2 or v1 and then the files of interest of every
+// cgroup, as path:line. Hosts with both hierarchies (the "hybrid" layout)
+// have the controllers in v1, so the v1 ones are read there.
+var cgroupsCommand = "if [ -f /sys/fs/cgroup/cgroup.controllers ]; then " +
+	"echo v2; " +
+	"find /sys/fs/cgroup -maxdepth " + strconv.Itoa(cgroupDepth+1) +
+	" \\( -name cpu.stat -o -name memory.current -o -name memory.max" +
+	" -o -name io.stat -o -name pids.current \\) -exec grep -H . {} +; " +
+	"else " +
+	"echo v1; " +
+	"for c in cpuacct memory blkio pids; do " +
+	"find /sys/fs/cgroup/$c/ -maxdepth " + strconv.Itoa(cgroupDepth+1) +
+	" \\( -name cpuacct.usage -o -name memory.usage_in_bytes -o -name memory.limit_in_bytes" +
+	" -o -name blkio.throttle.io_service_bytes -o -name pids.current \\) -exec grep -H . {} +; " +
+	"done; " +
+	"fi"
+
+type cgroupRaw struct {
+	usage  uint64 // CPU time, ns
+	rbytes uint64
+	wbytes uint64
+}
+
+// the cgroup counters that were fetched last time round, and the uptime then
+var (
+	preCgroups      = make(map[string]cgroupRaw)
+	preCgroupUptime time.Duration
+)
+
+func parseCgroups(lines string, stats *Stats) (err error) {
+	cgroups := make(map[string]*CgroupInfo)
+	nowCgroups := make(map[string]cgroupRaw)
+	v1 := false
+
+	scanner := bufio.NewScanner(strings.NewReader(lines))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "v1" || line == "v2" {
+			v1 = line == "v1"
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i == -1 || !strings.HasPrefix(line, "/sys/fs/cgroup/") {
+			continue
+		}
+		path, value := line[len("/sys/fs/cgroup/"):i], line[i+1:]
+		if v1 {
+			// drop the controller
+			if j := strings.Index(path, "/"); j != -1 {
+				path = path[j+1:]
+			}
+		}
+		file := path
+		path = ""
+		if j := strings.LastIndex(file, "/"); j != -1 {
+			path, file = file[:j], file[j+1:]
+		}
+		if len(path) == 0 {
+			// the root is the whole host
+			continue
+		}
+
+		info := cgroups[path]
+		if info == nil {
+			info = &CgroupInfo{Path: path}
+			cgroups[path] = info
+		}
+		raw := nowCgroups[path]
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			continue
+		}
+		switch file {
+		case "cpu.stat":
+			if len(fields) == 2 && fields[0] == "usage_usec" {
+				usecs, _ := strconv.ParseUint(fields[1], 10, 64)
+				raw.usage = usecs * 1000
+			}
+		case "cpuacct.usage":
+			raw.usage, _ = strconv.ParseUint(fields[0], 10, 64)
+		case "memory.current", "memory.usage_in_bytes":
+			info.MemUsage, _ = strconv.ParseUint(fields[0], 10, 64)
+		case "memory.max", "memory.limit_in_bytes":
+			// "max" in v2, and a huge number in v1
+			if limit, err := strconv.ParseUint(fields[0], 10, 64); err == nil && limit < 1<<62 {
+				info.MemLimit = limit
+			}
+		case "pids.current":
+			info.Pids, _ = strconv.ParseUint(fields[0], 10, 64)
+		case "io.stat":
+			// 8:0 rbytes=1 wbytes=2 rios=3 wios=4 ...
+			for _, field := range fields[1:] {
+				if kv := strings.SplitN(field, "=", 2); len(kv) == 2 {
+					val, _ := strconv.ParseUint(kv[1], 10, 64)
+					switch kv[0] {
+					case "rbytes":
+						raw.rbytes += val
+					case "wbytes":
+						raw.wbytes += val
+					}
+				}
+			}
+		case "blkio.throttle.io_service_bytes":
+			// 8:0 Read 1, and a Total line with no device
+			if len(fields) == 3 {
+				val, _ := strconv.ParseUint(fields[2], 10, 64)
+				switch fields[1] {
+				case "Read":
+					raw.rbytes += val
+				case "Write":
+					raw.wbytes += val
+				}
+			}
+		}
+		nowCgroups[path] = raw
+	}
+
+	elapsed := (stats.Uptime - preCgroupUptime).Seconds()
+	for path, info := range cgroups {
+		now := nowCgroups[path]
+		if pre, ok := preCgroups[path]; ok && elapsed > 0 {
+			if now.usage >= pre.usage {
+				info.CPU = float64(now.usage-pre.usage) / 1e9 / elapsed * 100
+			}
+			if now.rbytes >= pre.rbytes {
+				info.ReadRate = float64(now.rbytes-pre.rbytes) / elapsed
+			}
+			if now.wbytes >= pre.wbytes {
+				info.WriteRate = float64(now.wbytes-pre.wbytes) / elapsed
+			}
+		}
+		stats.Cgroups = append(stats.Cgroups, *info)
+	}
+
+	preCgroups = nowCgroups
+	preCgroupUptime = stats.Uptime
+	return
+}
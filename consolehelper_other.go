@@ -5,6 +5,7 @@ package main
 import (
 	"io"
 	"os"
+	"os/exec"
 )
 
 func clearConsole() {}
@@ -12,3 +13,11 @@ func clearConsole() {}
 func getOutput() io.Writer {
 	return os.Stdout
 }
+
+func shellCommand(command string) *exec.Cmd {
+	shell := os.Getenv("SHELL")
+	if len(shell) == 0 {
+		shell = "/bin/sh"
+	}
+	return exec.Command(shell, "-c", "exec "+command)
+}
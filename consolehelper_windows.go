@@ -16,3 +16,7 @@ func clearConsole() {
 func getOutput() io.Writer {
 	return colorable.NewColorableStdout()
 }
+
+func shellCommand(command string) *exec.Cmd {
+	return exec.Command("cmd", "/c", command)
+}
@@ -0,0 +1,213 @@
+/*
+
+rtop - the remote system monitoring utility
+
+Copyright (c) 2015 RapidLoop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ContainerInfo is set when the remote is itself a container, and has the
+// limits and usage of its own cgroup.
+type ContainerInfo struct {
+	Runtime string  // docker, lxc, podman ...
+	CPUs    float64 // the CPU quota, 0 if there is none
+	CPU     float64 // % of the quota, or of all the cores without one
+
+	MemLimit           uint64 // 0 if there is no limit
+	MemLimited         bool   // whether the memory stats are the container's
+	MemUsage           uint64
+	MemInactiveFile    uint64
+	MemFile            uint64
+	MemShmem           uint64
+	MemSlab            uint64
+	MemSlabReclaimable uint64
+	MemDirty           uint64
+	MemWriteback       uint64
+}
+
+// containerCommand prints what kind of container the remote is, if any,
+// and then the files of its own cgroup as path:line. Inside a container,
+// /sys/fs/cgroup has the container's cgroup at its root.
+const containerCommand = "echo runtime $(systemd-detect-virt -c); " +
+	"[ -f /.dockerenv ] && echo runtime docker; " +
+	"[ -f /run/.containerenv ] && echo runtime podman; " +
+	"tr '\\0' '\\n' </proc/1/environ | grep '^container='; " +
+	"if [ -f /sys/fs/cgroup/cgroup.controllers ]; then " +
+	"grep -H . /sys/fs/cgroup/memory.max /sys/fs/cgroup/memory.current " +
+	"/sys/fs/cgroup/memory.stat /sys/fs/cgroup/cpu.max /sys/fs/cgroup/cpu.stat; " +
+	"else " +
+	"grep -H . /sys/fs/cgroup/memory/memory.limit_in_bytes /sys/fs/cgroup/memory/memory.usage_in_bytes " +
+	"/sys/fs/cgroup/memory/memory.stat /sys/fs/cgroup/cpu/cpu.cfs_quota_us " +
+	"/sys/fs/cgroup/cpu/cpu.cfs_period_us /sys/fs/cgroup/cpuacct/cpuacct.usage; " +
+	"fi"
+
+// the CPU time used by the container last time round, in ns, and the
+// uptime then
+var (
+	preContainerUsage  uint64
+	preContainerUptime time.Duration
+)
+
+func parseContainer(lines string, stats *Stats) (err error) {
+	var c ContainerInfo
+	var usage uint64
+	var quota, period float64
+
+	scanner := bufio.NewScanner(strings.NewReader(lines))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "runtime ") || strings.HasPrefix(line, "container=") {
+			runtime := strings.TrimSpace(line[strings.IndexAny(line, " =")+1:])
+			if len(c.Runtime) == 0 && len(runtime) > 0 && runtime != "none" {
+				c.Runtime = runtime
+			}
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i == -1 {
+			continue
+		}
+		file, fields := line[strings.LastIndex(line[:i], "/")+1:i], strings.Fields(line[i+1:])
+		if len(fields) == 0 {
+			continue
+		}
+		val, _ := strconv.ParseUint(fields[0], 10, 64)
+		switch file {
+		case "memory.max", "memory.limit_in_bytes":
+			// "max" in v2, and a huge number in v1
+			if val < 1<<62 {
+				c.MemLimit = val
+			}
+		case "memory.current", "memory.usage_in_bytes":
+			c.MemUsage = val
+		case "memory.stat":
+			if len(fields) != 2 {
+				continue
+			}
+			val, _ = strconv.ParseUint(fields[1], 10, 64)
+			// v2 names, and then the v1 ones
+			switch fields[0] {
+			case "inactive_file", "total_inactive_file":
+				c.MemInactiveFile = val
+			case "file", "total_cache":
+				c.MemFile = val
+			case "shmem", "total_shmem":
+				c.MemShmem = val
+			case "slab":
+				c.MemSlab = val
+			case "slab_reclaimable":
+				c.MemSlabReclaimable = val
+			case "file_dirty", "total_dirty":
+				c.MemDirty = val
+			case "file_writeback", "total_writeback":
+				c.MemWriteback = val
+			}
+		case "cpu.max":
+			// quota period, the quota being "max" if there is none
+			if len(fields) == 2 {
+				quota, _ = strconv.ParseFloat(fields[0], 64)
+				period, _ = strconv.ParseFloat(fields[1], 64)
+			}
+		case "cpu.cfs_quota_us":
+			// -1 if there is none
+			quota, _ = strconv.ParseFloat(fields[0], 64)
+		case "cpu.cfs_period_us":
+			period, _ = strconv.ParseFloat(fields[0], 64)
+		case "cpu.stat":
+			if len(fields) == 2 && fields[0] == "usage_usec" {
+				usage, _ = strconv.ParseUint(fields[1], 10, 64)
+				usage *= 1000
+			}
+		case "cpuacct.usage":
+			usage = val
+		}
+	}
+	if len(c.Runtime) == 0 {
+		// not a container
+		return
+	}
+
+	if quota > 0 && period > 0 {
+		c.CPUs = quota / period
+	}
+	cpus := c.CPUs
+	if cpus == 0 {
+		// parseCPU has run already
+		cpus = float64(len(preCores))
+	}
+	elapsed := (stats.Uptime - preContainerUptime).Seconds()
+	if preContainerUsage > 0 && usage >= preContainerUsage && elapsed > 0 && cpus > 0 {
+		c.CPU = float64(usage-preContainerUsage) / 1e9 / elapsed / cpus * 100
+	}
+	preContainerUsage = usage
+	preContainerUptime = stats.Uptime
+
+	stats.Container = &c
+	applyContainerLimits(stats)
+	return
+}
+
+// applyContainerLimits makes the memory stats those of the container, when
+// it has a limit of its own below the host's RAM. Like docker stats, the
+// inactive file cache is not counted as used. Applying it again to stats it
+// has been applied to already changes nothing.
+func applyContainerLimits(stats *Stats) {
+	c := stats.Container
+	if c == nil || c.MemLimit == 0 || c.MemLimit > stats.MemTotal {
+		return
+	}
+	c.MemLimited = true
+	used := c.MemUsage
+	if c.MemInactiveFile < used {
+		used -= c.MemInactiveFile
+	} else {
+		used = 0
+	}
+	stats.MemTotal = c.MemLimit
+	var available, free uint64
+	if used < c.MemLimit {
+		available = c.MemLimit - used
+	}
+	if c.MemUsage < c.MemLimit {
+		free = c.MemLimit - c.MemUsage
+	}
+	if available < stats.MemAvailable {
+		stats.MemAvailable = available
+	}
+	if free < stats.MemFree {
+		stats.MemFree = free
+	}
+	stats.MemBuffers = 0
+	stats.MemCached = c.MemFile
+	stats.MemShmem = c.MemShmem
+	stats.MemSlab = c.MemSlab
+	stats.SReclaimable = c.MemSlabReclaimable
+	stats.MemDirty = c.MemDirty
+	stats.MemWriteback = c.MemWriteback
+}
@@ -38,3 +38,7 @@ func fmtBytes(val uint64) string {
 		return fmt.Sprintf("%6.2f GiB", float64(val)/1024.0/1024.0/1024.0)
 	}
 }
+
+func fmtRate(val float64) string {
+	return fmtBytes(uint64(val)) + "/s"
+}
@@ -0,0 +1,331 @@
+/*
+
+rtop - the remote system monitoring utility
+
+Copyright (c) 2015 RapidLoop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+var defaultKnownHostsFiles = []string{
+	"~/.ssh/known_hosts",
+	"~/.ssh/known_hosts2",
+}
+
+var globalKnownHostsFiles = []string{
+	"/etc/ssh/ssh_known_hosts",
+	"/etc/ssh/ssh_known_hosts2",
+}
+
+// hostKeyChecker verifies server host keys against the known_hosts files,
+// following the StrictHostKeyChecking semantics of ssh.
+type hostKeyChecker struct {
+	strict    string           // yes, no, accept-new or ask (the default)
+	userFiles []string         // new keys get added to the first one
+	decided   map[string]error // outcome for each host/key seen this run
+}
+
+func newHostKeyChecker(strict string, userFiles []string) *hostKeyChecker {
+	h := &hostKeyChecker{
+		strict:  strings.ToLower(strict),
+		decided: make(map[string]error),
+	}
+	if len(userFiles) == 0 {
+		userFiles = defaultKnownHostsFiles
+	}
+	for _, f := range userFiles {
+		if strings.ToLower(f) == "none" {
+			h.userFiles = nil
+			break
+		}
+		h.userFiles = append(h.userFiles, expandPath(f))
+	}
+	return h
+}
+
+// database returns a callback that checks keys against all the known_hosts
+// files that currently exist. It is reloaded every time so that keys added
+// during this run are picked up.
+func (h *hostKeyChecker) database() (ssh.HostKeyCallback, error) {
+	var files []string
+	for _, f := range append(h.userFiles[:len(h.userFiles):len(h.userFiles)], globalKnownHostsFiles...) {
+		if _, err := os.Stat(f); err == nil {
+			files = append(files, f)
+		}
+	}
+	if len(files) == 0 {
+		return func(string, net.Addr, ssh.PublicKey) error {
+			return &knownhosts.KeyError{}
+		}, nil
+	}
+	return knownhosts.New(files...)
+}
+
+// check is the ssh.HostKeyCallback for the client config.
+func (h *hostKeyChecker) check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	id := knownhosts.Line([]string{hostname}, key)
+	if err, ok := h.decided[id]; ok {
+		return err
+	}
+	err := h.verify(hostname, remote, key)
+	h.decided[id] = err
+	return err
+}
+
+func (h *hostKeyChecker) verify(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	db, err := h.database()
+	if err != nil {
+		return err
+	}
+	host := knownhosts.Normalize(hostname)
+
+	err = db(hostname, remote, key)
+	if cert, ok := key.(*ssh.Certificate); ok && err != nil {
+		if _, authorities := h.knownKeys(hostname); !hasPublicKey(authorities, cert.SignatureKey) {
+			// like ssh, fall back to the plain key if the certificate is
+			// not signed by a CA known for the host
+			key = cert.Key
+			err = db(hostname, remote, key)
+		}
+	}
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case *knownhosts.RevokedError:
+		return fmt.Errorf("host key for %s is revoked (%s:%d)",
+			host, e.Revoked.Filename, e.Revoked.Line)
+	case *knownhosts.KeyError:
+		for _, k := range e.Want {
+			if isCertAuthority(k) {
+				continue
+			}
+			log.Printf("WARNING: REMOTE HOST IDENTIFICATION HAS CHANGED!")
+			log.Printf("someone could be eavesdropping on you right now (man-in-the-middle attack)")
+			log.Printf("the %s key sent by the remote host is %s", key.Type(),
+				ssh.FingerprintSHA256(key))
+			return fmt.Errorf("host key verification failed: offending %s key in %s:%d",
+				k.Key.Type(), k.Filename, k.Line)
+		}
+	default:
+		return err
+	}
+
+	// the host is not known yet
+	switch h.strict {
+	case "yes":
+		return fmt.Errorf("no %s host key is known for %s and StrictHostKeyChecking is enabled",
+			key.Type(), host)
+	case "no", "off", "accept-new":
+	default:
+		if !h.confirm(host, remote, key) {
+			return fmt.Errorf("host key verification failed for %s", host)
+		}
+	}
+	h.add(host, key)
+	return nil
+}
+
+// confirm asks the user whether a previously unknown host key should be
+// trusted, like ssh does.
+func (h *hostKeyChecker) confirm(host string, remote net.Addr, key ssh.PublicKey) bool {
+	if terminal.IsTerminal(0) == false {
+		return false
+	}
+	defer pauseHandshake()()
+
+	fp := ssh.FingerprintSHA256(key)
+	fmt.Printf("The authenticity of host '%s (%s)' can't be established.\n", host, remote)
+	fmt.Printf("%s key fingerprint is %s.\n", key.Type(), fp)
+	fmt.Print("Are you sure you want to continue connecting (yes/no/[fingerprint])? ")
+	for {
+		answer, err := stdinReader.ReadString('\n')
+		if err != nil {
+			fmt.Println()
+			return false
+		}
+		answer = strings.TrimSpace(answer)
+		switch {
+		case strings.ToLower(answer) == "yes", answer == fp:
+			return true
+		case strings.ToLower(answer) == "no":
+			return false
+		}
+		fmt.Print("Please type 'yes', 'no' or the fingerprint: ")
+	}
+}
+
+// add appends the key to the first user known_hosts file.
+func (h *hostKeyChecker) add(host string, key ssh.PublicKey) {
+	if len(h.userFiles) == 0 {
+		return
+	}
+	path := h.userFiles[0]
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		log.Printf("warning: %v", err)
+		return
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Printf("warning: %v", err)
+		return
+	}
+	defer f.Close()
+
+	// don't glue the new entry onto an unterminated last line
+	line := knownhosts.Line([]string{host}, key) + "\n"
+	if fi, err := f.Stat(); err == nil && fi.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, fi.Size()-1); err == nil && last[0] != '\n' {
+			line = "\n" + line
+		}
+	}
+	if _, err := io.WriteString(f, line); err != nil {
+		log.Printf("warning: %v", err)
+		return
+	}
+	log.Printf("warning: permanently added '%s' (%s) to the list of known hosts",
+		host, key.Type())
+}
+
+// knownKeys returns the keys known for addr, and the keys of the
+// @cert-authority lines for it.
+func (h *hostKeyChecker) knownKeys(addr string) (keys, authorities []ssh.PublicKey) {
+	db, err := h.database()
+	if err != nil {
+		return
+	}
+	remote := &net.TCPAddr{IP: net.IPv4zero}
+	keyErr, ok := db(addr, remote, probeKey{}).(*knownhosts.KeyError)
+	if !ok {
+		return
+	}
+	for _, k := range keyErr.Want {
+		if isCertAuthority(k) {
+			authorities = append(authorities, k.Key)
+		} else {
+			keys = append(keys, k.Key)
+		}
+	}
+	return
+}
+
+// hostKeyAlgorithms returns the host key algorithms to offer to addr, with
+// those we already hold keys for at the front. Otherwise the server may
+// present a key type we have never seen, which would look like a changed
+// key. If a CA is known for the host, certificates are asked for first.
+func (h *hostKeyChecker) hostKeyAlgorithms(addr string) []string {
+	keys, authorities := h.knownKeys(addr)
+
+	supported := ssh.SupportedAlgorithms().HostKeys
+	var algos []string
+	if len(authorities) > 0 {
+		for _, a := range supported {
+			if strings.Contains(a, "-cert-") {
+				algos = append(algos, a)
+			}
+		}
+	}
+	for _, k := range keys {
+		for _, a := range keyAlgorithms(k.Type()) {
+			if contains(supported, a) && !contains(algos, a) {
+				algos = append(algos, a)
+			}
+		}
+	}
+	if len(algos) == 0 {
+		return nil
+	}
+	for _, a := range supported {
+		if !contains(algos, a) {
+			algos = append(algos, a)
+		}
+	}
+	return algos
+}
+
+// keyAlgorithms lists the signature algorithms usable with a key type.
+func keyAlgorithms(keyType string) []string {
+	if keyType == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return []string{keyType}
+}
+
+// isCertAuthority reports whether a known key came from a @cert-authority
+// line. knownhosts does not tell us, so look at the line itself.
+func isCertAuthority(k knownhosts.KnownKey) bool {
+	f, err := os.Open(k.Filename)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		if n == k.Line {
+			line := strings.TrimSpace(scanner.Text())
+			return strings.HasPrefix(line, "@cert-authority")
+		}
+	}
+	return false
+}
+
+func hasPublicKey(keys []ssh.PublicKey, key ssh.PublicKey) bool {
+	for _, k := range keys {
+		if bytes.Equal(k.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// probeKey never matches anything, so checking it against the known_hosts
+// database yields the list of keys known for a host.
+type probeKey struct{}
+
+func (probeKey) Type() string                                 { return "rtop-probe" }
+func (probeKey) Marshal() []byte                              { return []byte("rtop-probe") }
+func (probeKey) Verify(data []byte, sig *ssh.Signature) error { return fmt.Errorf("probe key") }
@@ -0,0 +1,256 @@
+/*
+
+rtop - the remote system monitoring utility
+
+Copyright (c) 2015 RapidLoop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// newHostCert returns a host certificate for key, signed by ca.
+func newHostCert(t *testing.T, key ssh.PublicKey, ca ssh.Signer, principal string) *ssh.Certificate {
+	t.Helper()
+	cert := &ssh.Certificate{
+		Key:             key,
+		CertType:        ssh.HostCert,
+		ValidPrincipals: []string{principal},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestHostKeyChecker(t *testing.T) {
+	hostKey := newTestSigner(t).PublicKey()
+	otherKey := newTestSigner(t).PublicKey()
+	ca := newTestSigner(t)
+	otherCA := newTestSigner(t)
+	line := func(host string, key ssh.PublicKey) string {
+		return knownhosts.Line([]string{host}, key) + "\n"
+	}
+	caLine := "@cert-authority *.example.com " + string(ssh.MarshalAuthorizedKey(ca.PublicKey()))
+
+	tests := []struct {
+		name       string
+		knownHosts string
+		strict     string
+		host       string
+		key        ssh.PublicKey
+		wantErr    string // empty if the key is to be accepted
+		wantAdded  bool   // whether the key gets added to known_hosts
+	}{
+		{
+			name:       "known key",
+			knownHosts: line("web.example.com", hostKey),
+			strict:     "yes",
+			host:       "web.example.com",
+			key:        hostKey,
+		},
+		{
+			name:       "known key on another port",
+			knownHosts: line("[web.example.com]:2222", hostKey),
+			strict:     "yes",
+			host:       "web.example.com:2222",
+			key:        hostKey,
+		},
+		{
+			name:       "changed key",
+			knownHosts: line("web.example.com", otherKey),
+			strict:     "no",
+			host:       "web.example.com",
+			key:        hostKey,
+			wantErr:    "host key verification failed",
+		},
+		{
+			name: "revoked key",
+			knownHosts: "@revoked * " + string(ssh.MarshalAuthorizedKey(hostKey)) +
+				line("web.example.com", hostKey),
+			strict:  "no",
+			host:    "web.example.com",
+			key:     hostKey,
+			wantErr: "revoked",
+		},
+		{
+			name:       "hashed entry",
+			knownHosts: line(knownhosts.HashHostname("web.example.com"), hostKey),
+			strict:     "yes",
+			host:       "web.example.com",
+			key:        hostKey,
+		},
+		{
+			name:       "hashed entry with a changed key",
+			knownHosts: line(knownhosts.HashHostname("web.example.com"), otherKey),
+			strict:     "no",
+			host:       "web.example.com",
+			key:        hostKey,
+			wantErr:    "host key verification failed",
+		},
+		{
+			name:       "host cert signed by a known CA",
+			knownHosts: caLine,
+			strict:     "yes",
+			host:       "web.example.com",
+			key:        newHostCert(t, hostKey, ca, "web.example.com"),
+		},
+		{
+			name:       "host cert for another host",
+			knownHosts: caLine,
+			strict:     "yes",
+			host:       "web.example.com",
+			key:        newHostCert(t, hostKey, ca, "db.example.com"),
+			wantErr:    "principal",
+		},
+		{
+			name:       "host cert from another CA, plain key known",
+			knownHosts: caLine + line("web.example.com", hostKey),
+			strict:     "yes",
+			host:       "web.example.com",
+			key:        newHostCert(t, hostKey, otherCA, "web.example.com"),
+		},
+		{
+			name:       "host cert from another CA, plain key changed",
+			knownHosts: caLine + line("web.example.com", otherKey),
+			strict:     "no",
+			host:       "web.example.com",
+			key:        newHostCert(t, hostKey, otherCA, "web.example.com"),
+			wantErr:    "host key verification failed",
+		},
+		{
+			name:       "host cert with no CA known, plain key known",
+			knownHosts: line("web.example.com", hostKey),
+			strict:     "yes",
+			host:       "web.example.com",
+			key:        newHostCert(t, hostKey, ca, "web.example.com"),
+		},
+		{
+			name:       "unknown host with StrictHostKeyChecking=yes",
+			knownHosts: line("db.example.com", hostKey),
+			strict:     "yes",
+			host:       "web.example.com",
+			key:        hostKey,
+			wantErr:    "StrictHostKeyChecking",
+		},
+		{
+			name:       "unknown host with accept-new",
+			knownHosts: line("db.example.com", otherKey),
+			strict:     "accept-new",
+			host:       "web.example.com",
+			key:        hostKey,
+			wantAdded:  true,
+		},
+		{
+			name:       "accept-new after an unterminated last line",
+			knownHosts: strings.TrimSuffix(line("db.example.com", otherKey), "\n"),
+			strict:     "accept-new",
+			host:       "web.example.com:2222",
+			key:        hostKey,
+			wantAdded:  true,
+		},
+		{
+			name:      "accept-new with no known_hosts yet",
+			strict:    "accept-new",
+			host:      "web.example.com",
+			key:       hostKey,
+			wantAdded: true,
+		},
+	}
+
+	saved := globalKnownHostsFiles
+	globalKnownHostsFiles = nil
+	defer func() { globalKnownHostsFiles = saved }()
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	remote := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 22}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "known_hosts")
+			if len(tt.knownHosts) > 0 {
+				if err := os.WriteFile(path, []byte(tt.knownHosts), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			host := tt.host
+			if !strings.Contains(host, ":") {
+				host += ":22"
+			}
+
+			h := newHostKeyChecker(tt.strict, []string{path})
+			err := h.check(host, remote, tt.key)
+			if len(tt.wantErr) == 0 && err != nil {
+				t.Fatalf("check: %v", err)
+			}
+			if len(tt.wantErr) > 0 && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("check: got %v, want an error containing %q", err, tt.wantErr)
+			}
+
+			data, _ := os.ReadFile(path)
+			want := tt.knownHosts
+			if tt.wantAdded {
+				if len(want) > 0 && !strings.HasSuffix(want, "\n") {
+					want += "\n"
+				}
+				want += line(knownhosts.Normalize(host), tt.key)
+			}
+			if string(data) != want {
+				t.Errorf("known_hosts is\n%s\nwant\n%s", data, want)
+			}
+			if tt.wantAdded {
+				// and the key is known from now on
+				h := newHostKeyChecker("yes", []string{path})
+				if err := h.check(host, remote, tt.key); err != nil {
+					t.Errorf("check after adding: %v", err)
+				}
+			}
+		})
+	}
+}
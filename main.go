@@ -26,9 +26,11 @@ THE SOFTWARE.
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
 	"os/signal"
 	"os/user"
@@ -46,6 +48,17 @@ const VERSION = "1.0"
 const DEFAULT_REFRESH = 5 // default refresh interval in seconds
 
 var currentUser *user.User
+var verbose bool
+
+// the processes and cgroups tables show the first topCount by topSort
+var topCount = 10
+var topSort = "cpu"
+
+func debugf(format string, v ...interface{}) {
+	if verbose {
+		log.Printf(format, v...)
+	}
+}
 
 //----------------------------------------------------------------------------
 // Command-line processing
@@ -55,14 +68,30 @@ func usage(code int) {
 		`rtop %s - (c) 2015 RapidLoop - MIT Licensed - http://rtop-monitor.org
 rtop monitors server statistics over an ssh connection
 
-Usage: rtop [-i private-key-file] [user@]host[:port] [interval]
+Usage: rtop [-v] [-i private-key-file]... [-J jump-hosts] [-n count] [-s cpu|mem]
+            [-w unit[,unit...]]... [user@]host[:port] [interval]
 
+	-v
+		verbose mode, report details of connecting and authenticating
 	-i private-key-file
-		PEM-encoded private key file to use (default: ~/.ssh/id_rsa if present)
+		private key file to use, in OpenSSH, PEM or PKCS#8 format; can
+		be given more than once (default: ~/.ssh/id_ed25519, id_ecdsa,
+		id_rsa and id_dsa, those that are present)
+	-J [user@]host[:port][,...]
+		connect through these jump hosts, one after the other
+	-n count
+		number of processes and of cgroups to show, 0 for none
+		(default: 10)
+	-s cpu|mem
+		show the processes and cgroups using the most CPU or memory
+		(default: cpu)
+	-w unit[,unit...]
+		systemd units to show the state of, along with the failed ones;
+		can be given more than once
 	[user@]host[:port]
 		the SSH server to connect to, with optional username and port
 	interval
-		refresh interval in seconds (default: %d)
+		refresh interval in seconds, may be fractional (default: %d)
 
 `, VERSION, DEFAULT_REFRESH)
 	os.Exit(code)
@@ -77,9 +106,45 @@ func shift(q []string) (ok bool, val string, qnew []string) {
 	return
 }
 
-func parseCmdLine() (host string, port int, user, key string, interval time.Duration) {
+// parseHostSpec splits a [user@]host[:port] string.
+func parseHostSpec(spec string) (user, host string, port int, err error) {
+	// user, addr
+	var addr string
+	if i := strings.Index(spec, "@"); i != -1 {
+		user = spec[:i]
+		if i+1 >= len(spec) {
+			err = fmt.Errorf("bad host: %q", spec)
+			return
+		}
+		addr = spec[i+1:]
+	} else {
+		// user remains ""
+		addr = spec
+	}
+
+	// addr -> host, port
+	if p := strings.Split(addr, ":"); len(p) == 2 {
+		host = p[0]
+		if port, err = strconv.Atoi(p[1]); err != nil {
+			err = fmt.Errorf("bad port: %v", err)
+			return
+		}
+		if port <= 0 || port >= 65536 {
+			err = fmt.Errorf("bad port: %d", port)
+			return
+		}
+	} else {
+		host = addr
+		// port remains 0
+	}
+	return
+}
+
+func parseCmdLine() (host string, port int, user string, keys []string, jump string,
+	units []string, interval time.Duration) {
 	ok, arg, args := shift(os.Args)
 	var argKey, argHost, argInt string
+	var argKeys []string
 	for ok {
 		ok, arg, args = shift(args)
 		if !ok {
@@ -88,11 +153,47 @@ func parseCmdLine() (host string, port int, user, key string, interval time.Dura
 		if arg == "-h" || arg == "--help" || arg == "--version" {
 			usage(0)
 		}
-		if arg == "-i" {
+		if arg == "-v" {
+			verbose = true
+		} else if arg == "-i" {
 			ok, argKey, args = shift(args)
 			if !ok {
 				usage(1)
 			}
+			argKeys = append(argKeys, argKey)
+		} else if arg == "-J" {
+			ok, jump, args = shift(args)
+			if !ok {
+				usage(1)
+			}
+		} else if arg == "-w" {
+			var list string
+			if ok, list, args = shift(args); !ok {
+				usage(1)
+			}
+			for _, unit := range strings.Split(list, ",") {
+				if unit = strings.TrimSpace(unit); len(unit) > 0 {
+					units = append(units, unit)
+				}
+			}
+		} else if arg == "-n" {
+			var count string
+			if ok, count, args = shift(args); !ok {
+				usage(1)
+			}
+			var err error
+			if topCount, err = strconv.Atoi(count); err != nil || topCount < 0 {
+				log.Printf("bad process count: %q", count)
+				usage(1)
+			}
+		} else if arg == "-s" {
+			if ok, topSort, args = shift(args); !ok {
+				usage(1)
+			}
+			if topSort != "cpu" && topSort != "mem" {
+				log.Printf("bad sort order: %q", topSort)
+				usage(1)
+			}
 		} else if len(argHost) == 0 {
 			argHost = arg
 		} else if len(argInt) == 0 {
@@ -105,53 +206,28 @@ func parseCmdLine() (host string, port int, user, key string, interval time.Dura
 		usage(1)
 	}
 
-	// key
-	if len(argKey) != 0 {
-		key = argKey
-	} // else key remains ""
-
-	// user, addr
-	var addr string
-	if i := strings.Index(argHost, "@"); i != -1 {
-		user = argHost[:i]
-		if i+1 >= len(argHost) {
-			usage(1)
-		}
-		addr = argHost[i+1:]
-	} else {
-		// user remains ""
-		addr = argHost
-	}
+	// keys
+	keys = argKeys // may remain empty
 
-	// addr -> host, port
-	if p := strings.Split(addr, ":"); len(p) == 2 {
-		host = p[0]
-		var err error
-		if port, err = strconv.Atoi(p[1]); err != nil {
-			log.Printf("bad port: %v", err)
-			usage(1)
-		}
-		if port <= 0 || port >= 65536 {
-			log.Printf("bad port: %d", port)
-			usage(1)
-		}
-	} else {
-		host = addr
-		// port remains 0
+	// user, host, port
+	var err error
+	if user, host, port, err = parseHostSpec(argHost); err != nil {
+		log.Print(err)
+		usage(1)
 	}
 
 	// interval
 	if len(argInt) > 0 {
-		i, err := strconv.ParseUint(argInt, 10, 64)
+		i, err := strconv.ParseFloat(argInt, 64)
 		if err != nil {
 			log.Printf("bad interval: %v", err)
 			usage(1)
 		}
-		if i <= 0 {
-			log.Printf("bad interval: %d", i)
+		if i < 0.1 {
+			log.Printf("bad interval: %v", i)
 			usage(1)
 		}
-		interval = time.Duration(i) * time.Second
+		interval = time.Duration(i * float64(time.Second))
 	} // else interval remains 0
 
 	return
@@ -165,8 +241,8 @@ func main() {
 	log.SetFlags(0)
 
 	// get params from command line
-	host, port, username, key, interval := parseCmdLine()
-	// log.Printf("cmdline: %s %d %s %s", host, port, username, key)
+	host, port, username, keys, jump, units, interval := parseCmdLine()
+	// log.Printf("cmdline: %s %d %s %v", host, port, username, keys)
 
 	// get current user
 	var err error
@@ -176,52 +252,41 @@ func main() {
 		return
 	}
 
-	// fill from ~/.ssh/config if possible
-	sshConfig := filepath.Join(currentUser.HomeDir, ".ssh", "config")
-	if _, err := os.Stat(sshConfig); err == nil {
-		if parseSshConfig(sshConfig) {
-			shost, sport, suser, skey := getSshEntry(host)
-			if len(shost) > 0 {
-				host = shost
-			}
-			if sport != 0 && port == 0 {
-				port = sport
-			}
-			if len(suser) > 0 && len(username) == 0 {
-				username = suser
-			}
-			if len(skey) > 0 && len(key) == 0 {
-				key = skey
-			}
-			// log.Printf("after sshconfig: %s %d %s %s", host, port, username, key)
+	// read ~/.ssh/config and then /etc/ssh/ssh_config, if present
+	sshConfigs := []string{
+		filepath.Join(currentUser.HomeDir, ".ssh", "config"),
+		"/etc/ssh/ssh_config",
+	}
+	for _, sshConfig := range sshConfigs {
+		if _, err := os.Stat(sshConfig); err == nil {
+			parseSshConfig(sshConfig)
 		}
 	}
 
-	// fill in still-unknown ones with defaults
-	if port == 0 {
-		port = 22
-	}
-	if len(username) == 0 {
-		username = currentUser.Username
-	}
-	if len(key) == 0 {
-		idrsap := filepath.Join(currentUser.HomeDir, ".ssh", "id_rsa")
-		if _, err := os.Stat(idrsap); err == nil {
-			key = idrsap
-		}
+	// combine with the ssh config, and fill in still-unknown ones with defaults
+	entry := getHostConfig(host, port, username, keys)
+	if len(jump) > 0 {
+		entry.ProxyJump = jump
 	}
 	if interval == 0 {
 		interval = DEFAULT_REFRESH * time.Second
 	}
-	// log.Printf("after defaults: %s %d %s %s", host, port, username, key)
+	// a command that takes longer than this is given up on, so that one
+	// stuck command does not hold up the refreshes; the collect script
+	// needs at least 2s, as each of its commands gets half of it
+	commandTimeout = interval
+	if commandTimeout < 2*time.Second {
+		commandTimeout = 2 * time.Second
+	}
+	// log.Printf("after defaults: %+v", entry)
 	// log.Printf("interval: %v", interval)
 
-	addr := fmt.Sprintf("%s:%d", host, port)
-	client := sshConnect(username, addr, key)
+	watchServices(units)
+	r := newRemote(&entry)
 
 	output := getOutput()
 	// the loop
-	showStats(output, client)
+	refresh(output, r)
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
 	timer := time.Tick(interval)
@@ -232,40 +297,84 @@ func main() {
 			done = true
 			fmt.Println()
 		case <-timer:
-			showStats(output, client)
+			refresh(output, r)
+		}
+	}
+}
+
+// refresh shows the stats, or the connection state while the connection to
+// the remote is down.
+func refresh(output io.Writer, r *remote) {
+	client := r.Client()
+	if client == nil {
+		showStatus(output, r.Status())
+		if client = r.Reconnect(); client == nil {
+			showStatus(output, r.Status())
+			return
 		}
 	}
+	showStats(output, client)
+}
+
+func showStatus(output io.Writer, status string) {
+	clearConsole()
+	fmt.Fprintf(output, "%s%s%s%s\n\n", escClear, escRed, status, escReset)
 }
 
 func showStats(output io.Writer, client *ssh.Client) {
 	stats := Stats{}
 	getAllStats(client, &stats)
 	clearConsole()
-	used := stats.MemTotal - stats.MemFree - stats.MemBuffers - stats.MemCached
+	used, cached := memUsage(&stats)
+	var container, cpuTitle, containerCPU, memTitle string
+	if c := stats.Container; c != nil {
+		container = fmt.Sprintf(" [%scontainer: %s%s]", escBrightWhite, c.Runtime, escReset)
+		// /proc/stat is not namespaced, so the breakdown and the cores are
+		// those of the host
+		cpuTitle = " (host-wide)"
+		limit := "all CPUs (no limit)"
+		if c.CPUs > 0 {
+			limit = fmt.Sprintf("its limit of %.2f CPUs", c.CPUs)
+		}
+		containerCPU = fmt.Sprintf("    container: %s%.2f%s%% of %s\n",
+			escBrightWhite, c.CPU, escReset, limit)
+		if c.MemLimited {
+			memTitle = " (container, limited to " + strings.TrimSpace(fmtBytes(c.MemLimit)) + ")"
+		} else if c.MemLimit > 0 {
+			memTitle = " (host-wide, the container limit of " +
+				strings.TrimSpace(fmtBytes(c.MemLimit)) + " is above the host's RAM)"
+		}
+	}
 	fmt.Fprintf(output,
-		`%s%s%s%s up %s%s%s
+		`%s%s%s%s up %s%s%s%s
 
 Load:
     %s%s %s %s%s
 
-CPU:
-    %s%.2f%s%% user, %s%.2f%s%% sys, %s%.2f%s%% nice, %s%.2f%s%% idle, %s%.2f%s%% iowait, %s%.2f%s%% hardirq, %s%.2f%s%% softirq, %s%.2f%s%% guest
-
+CPU%s:
+    %s%.2f%s%% user, %s%.2f%s%% sys, %s%.2f%s%% nice, %s%.2f%s%% idle, %s%.2f%s%% iowait, %s%.2f%s%% hardirq, %s%.2f%s%% softirq, %s%.2f%s%% steal, %s%.2f%s%% guest, %s%.2f%s%% guest nice
+%s%s
 Processes:
     %s%s%s running of %s%s%s total
 
-Memory:
-    free    = %s%s%s
-    used    = %s%s%s
-    buffers = %s%s%s
-    cached  = %s%s%s
-    swap    = %s%s%s free of %s%s%s
-
+Memory%s:
+    free      = %s%s%s
+    used      = %s%s%s
+    available = %s%s%s
+    buffers   = %s%s%s
+    cached    = %s%s%s
+    shared    = %s%s%s
+    slab      = %s%s%s (%s%s%s reclaimable)
+    dirty     = %s%s%s, writeback = %s%s%s
+    committed = %s%s%s of %s%s%s limit
+    swap      = %s%s%s free of %s%s%s
 `,
 		escClear,
 		escBrightWhite, stats.Hostname, escReset,
 		escBrightWhite, fmtUptime(&stats), escReset,
+		container,
 		escBrightWhite, stats.Load1, stats.Load5, stats.Load10, escReset,
+		cpuTitle,
 		escBrightWhite, stats.CPU.User, escReset,
 		escBrightWhite, stats.CPU.System, escReset,
 		escBrightWhite, stats.CPU.Nice, escReset,
@@ -273,16 +382,67 @@ Memory:
 		escBrightWhite, stats.CPU.Iowait, escReset,
 		escBrightWhite, stats.CPU.Irq, escReset,
 		escBrightWhite, stats.CPU.SoftIrq, escReset,
+		escBrightWhite, stats.CPU.Steal, escReset,
 		escBrightWhite, stats.CPU.Guest, escReset,
+		escBrightWhite, stats.CPU.GuestNice, escReset,
+		containerCPU,
+		coreBars(stats.Cores),
 		escBrightWhite, stats.RunningProcs, escReset,
 		escBrightWhite, stats.TotalProcs, escReset,
+		memTitle,
 		escBrightWhite, fmtBytes(stats.MemFree), escReset,
 		escBrightWhite, fmtBytes(used), escReset,
+		escBrightWhite, fmtBytes(stats.MemAvailable), escReset,
 		escBrightWhite, fmtBytes(stats.MemBuffers), escReset,
-		escBrightWhite, fmtBytes(stats.MemCached), escReset,
+		escBrightWhite, fmtBytes(cached), escReset,
+		escBrightWhite, fmtBytes(stats.MemShmem), escReset,
+		escBrightWhite, fmtBytes(stats.MemSlab), escReset,
+		escBrightWhite, fmtBytes(stats.SReclaimable), escReset,
+		escBrightWhite, fmtBytes(stats.MemDirty), escReset,
+		escBrightWhite, fmtBytes(stats.MemWriteback), escReset,
+		escBrightWhite, fmtBytes(stats.CommittedAS), escReset,
+		escBrightWhite, fmtBytes(stats.CommitLimit), escReset,
 		escBrightWhite, fmtBytes(stats.SwapFree), escReset,
 		escBrightWhite, fmtBytes(stats.SwapTotal), escReset,
 	)
+	if stats.HugePages > 0 {
+		fmt.Fprintf(output, "    hugepages = %s%d%s free of %s%d%s (%s each)\n",
+			escBrightWhite, stats.HugePagesFree, escReset,
+			escBrightWhite, stats.HugePages, escReset,
+			fmtBytes(stats.HugePageSize))
+	}
+	fmt.Fprintf(output, "    pressure  = %s%s%s\n\n",
+		escBrightWhite, memPressure(&stats), escReset)
+	if stats.StaleErr != nil {
+		fmt.Fprintf(output, "%sstale (%v): all%s\n\n",
+			escRed, stats.StaleErr, escReset)
+	} else if len(stats.Stale) > 0 {
+		fmt.Fprintf(output, "%sstale (timed out): %s%s\n\n",
+			escRed, strings.Join(stats.Stale, ", "), escReset)
+	}
+	if stats.Systemd {
+		showServices(output, &stats)
+	}
+	if len(stats.Pressure) > 0 {
+		fmt.Fprintln(output, "Pressure:")
+		for _, resource := range []string{"cpu", "memory", "io"} {
+			info, ok := stats.Pressure[resource]
+			if !ok {
+				continue
+			}
+			showPSILine(output, resource, "some", info.Some)
+			if info.HasFull {
+				showPSILine(output, "", "full", info.Full)
+			}
+		}
+		fmt.Fprintln(output)
+	}
+	if topCount > 0 && len(stats.Procs) > 0 {
+		showProcs(output, stats.Procs)
+	}
+	if topCount > 0 && len(stats.Cgroups) > 0 {
+		showCgroups(output, stats.Cgroups)
+	}
 	if len(stats.FSInfos) > 0 {
 		fmt.Println("Filesystems:")
 		for _, fs := range stats.FSInfos {
@@ -294,6 +454,23 @@ Memory:
 		}
 		fmt.Println()
 	}
+	if len(stats.DiskIO) > 0 {
+		fmt.Fprintln(output, "Disk I/O:")
+		for _, d := range stats.DiskIO {
+			fmt.Fprintf(output, "    %s%8s%s: read %s%s%s (%s%.0f%s iops), write %s%s%s (%s%.0f%s iops)\n",
+				escBrightWhite, d.Device, escReset,
+				escBrightWhite, fmtRate(d.ReadBytes), escReset,
+				escBrightWhite, d.ReadIOPS, escReset,
+				escBrightWhite, fmtRate(d.WriteBytes), escReset,
+				escBrightWhite, d.WriteIOPS, escReset,
+			)
+			fmt.Fprintf(output, "              await %s%.2f%s ms, util %s%.1f%s%%\n",
+				escBrightWhite, d.Await, escReset,
+				escBrightWhite, d.Util, escReset,
+			)
+		}
+		fmt.Fprintln(output)
+	}
 	if len(stats.NetIntf) > 0 {
 		fmt.Println("Network Interfaces:")
 		keys := make([]string, 0, len(stats.NetIntf))
@@ -318,10 +495,195 @@ Memory:
 				escBrightWhite, fmtBytes(info.Rx), escReset,
 				escBrightWhite, fmtBytes(info.Tx), escReset,
 			)
+			fmt.Fprintf(output, "      rx rate = %s%s%s (%s%.0f%s pkt/s), tx rate = %s%s%s (%s%.0f%s pkt/s)\n",
+				escBrightWhite, fmtRate(info.RxRate), escReset,
+				escBrightWhite, info.RxPacketRate, escReset,
+				escBrightWhite, fmtRate(info.TxRate), escReset,
+				escBrightWhite, info.TxPacketRate, escReset,
+			)
+			fmt.Fprintf(output, "      rx errs %d drop %d fifo %d frame %d, tx errs %d drop %d fifo %d colls %d carrier %d\n",
+				info.RxErrs, info.RxDrop, info.RxFifo, info.RxFrame,
+				info.TxErrs, info.TxDrop, info.TxFifo, info.TxColls, info.TxCarrier,
+			)
 			fmt.Println()
 		}
 		fmt.Println()
 	}
+	if len(stats.TCPStates) > 0 || len(stats.NetCounters) > 0 {
+		showSockets(output, &stats)
+	}
+}
+
+func showSockets(output io.Writer, stats *Stats) {
+	fmt.Fprintln(output, "Sockets:")
+	var states []string
+	for _, state := range tcpStates {
+		if n := stats.TCPStates[state]; n > 0 {
+			states = append(states, fmt.Sprintf("%s%d%s %s", escBrightWhite, n, escReset, state))
+		}
+	}
+	if len(states) > 0 {
+		fmt.Fprintf(output, "    tcp = %s\n", strings.Join(states, ", "))
+	}
+	fmt.Fprintf(output, "    udp = %s%d%s sockets\n", escBrightWhite, stats.UDPSockets, escReset)
+
+	sort.Slice(stats.Listening, func(i, j int) bool {
+		a, b := stats.Listening[i], stats.Listening[j]
+		if a.Port != b.Port {
+			return a.Port < b.Port
+		}
+		return a.Addr < b.Addr
+	})
+	for _, proto := range []string{"tcp", "udp"} {
+		var addrs []string
+		for _, l := range stats.Listening {
+			if strings.TrimSuffix(l.Proto, "6") == proto {
+				addrs = append(addrs, net.JoinHostPort(l.Addr, strconv.Itoa(l.Port)))
+			}
+		}
+		if len(addrs) > 0 {
+			fmt.Fprintf(output, "    listening on %s: %s\n", proto, strings.Join(addrs, ", "))
+		}
+	}
+
+	for _, c := range stats.NetCounters {
+		fmt.Fprintf(output, "    %-22s = %s%12d%s (%s%.1f%s/s)\n", c.Name,
+			escBrightWhite, c.Value, escReset,
+			escBrightWhite, c.Rate, escReset)
+	}
+	fmt.Fprintln(output)
+}
+
+func showServices(output io.Writer, stats *Stats) {
+	fmt.Fprintln(output, "Services:")
+	if len(stats.FailedUnits) == 0 {
+		fmt.Fprintf(output, "    %sno failed units%s\n", escBrightWhite, escReset)
+	}
+	for _, unit := range stats.FailedUnits {
+		fmt.Fprintf(output, "    %s%s %s (%s)%s\n",
+			escRed, unit.Name, unit.Active, unit.Sub, escReset)
+	}
+	for _, unit := range stats.WatchedUnits {
+		color := escBrightWhite
+		if unit.Active != "active" {
+			color = escRed
+		}
+		state := unit.Active + " (" + unit.Sub + ")"
+		if unit.Load != "loaded" {
+			state = unit.Load
+		}
+		fmt.Fprintf(output, "    %s %s%s%s\n", unit.Name, color, state, escReset)
+	}
+	fmt.Fprintln(output)
+}
+
+func showPSILine(output io.Writer, resource, kind string, psi PSILine) {
+	fmt.Fprintf(output, "    %-6s %s %s%6.2f%s%% %s%6.2f%s%% %s%6.2f%s%% (10s/60s/300s), total %s%s%s\n",
+		resource, kind,
+		escBrightWhite, psi.Avg10, escReset,
+		escBrightWhite, psi.Avg60, escReset,
+		escBrightWhite, psi.Avg300, escReset,
+		escBrightWhite, psi.Total.Truncate(time.Millisecond), escReset,
+	)
+}
+
+func showProcs(output io.Writer, procs []ProcInfo) {
+	sort.Slice(procs, func(i, j int) bool {
+		if topSort == "mem" && procs[i].RSS != procs[j].RSS {
+			return procs[i].RSS > procs[j].RSS
+		}
+		if procs[i].CPU != procs[j].CPU {
+			return procs[i].CPU > procs[j].CPU
+		}
+		return procs[i].RSS > procs[j].RSS
+	})
+	if len(procs) > topCount {
+		procs = procs[:topCount]
+	}
+
+	const cmdWidth = 40
+	fmt.Fprintf(output, "Top Processes:\n    %6s %-8s %s %6s %10s  %s\n",
+		"PID", "USER", "S", "CPU%", "RSS", "COMMAND")
+	for _, p := range procs {
+		user, cmd := p.User, p.Command
+		if len(user) > 8 {
+			user = user[:7] + "+"
+		}
+		if len(cmd) > cmdWidth {
+			cmd = cmd[:cmdWidth]
+		}
+		fmt.Fprintf(output, "    %6d %-8s %s %s%6.1f%s %s%10s%s  %s\n",
+			p.PID, user, p.State,
+			escBrightWhite, p.CPU, escReset,
+			escBrightWhite, fmtBytes(p.RSS), escReset,
+			cmd)
+	}
+	fmt.Fprintln(output)
+}
+
+func showCgroups(output io.Writer, cgroups []CgroupInfo) {
+	sort.Slice(cgroups, func(i, j int) bool {
+		if topSort == "mem" && cgroups[i].MemUsage != cgroups[j].MemUsage {
+			return cgroups[i].MemUsage > cgroups[j].MemUsage
+		}
+		if cgroups[i].CPU != cgroups[j].CPU {
+			return cgroups[i].CPU > cgroups[j].CPU
+		}
+		return cgroups[i].MemUsage > cgroups[j].MemUsage
+	})
+	if len(cgroups) > topCount {
+		cgroups = cgroups[:topCount]
+	}
+
+	const pathWidth = 30
+	fmt.Fprintf(output, "Cgroups:\n    %-*s %6s %10s %10s %12s %12s %5s\n",
+		pathWidth, "CGROUP", "CPU%", "MEM", "LIMIT", "READ", "WRITE", "PIDS")
+	for _, c := range cgroups {
+		// the end of the path says the most
+		path := c.Path
+		if len(path) > pathWidth {
+			path = "..." + path[len(path)-pathWidth+3:]
+		}
+		limit := "-"
+		if c.MemLimit > 0 {
+			limit = fmtBytes(c.MemLimit)
+		}
+		fmt.Fprintf(output, "    %-*s %s%6.1f%s %s%10s%s %10s %s%12s%s %s%12s%s %5d\n",
+			pathWidth, path,
+			escBrightWhite, c.CPU, escReset,
+			escBrightWhite, fmtBytes(c.MemUsage), escReset,
+			limit,
+			escBrightWhite, fmtRate(c.ReadRate), escReset,
+			escBrightWhite, fmtRate(c.WriteRate), escReset,
+			c.Pids)
+	}
+	fmt.Fprintln(output)
+}
+
+// coreBars shows how busy each core is, several to a line.
+func coreBars(cores []CoreInfo) string {
+	const perLine, barWidth = 4, 8
+	var buf bytes.Buffer
+	for i, core := range cores {
+		busy := 100 - core.Idle - core.Iowait
+		if busy < 0 {
+			busy = 0
+		}
+		n := int(busy*barWidth/100 + 0.5)
+		if i > 0 && i%perLine == 0 {
+			buf.WriteString("\n")
+		}
+		if i%perLine == 0 {
+			buf.WriteString("   ")
+		}
+		fmt.Fprintf(&buf, " %3s [%s%-*s%s]%4.0f%%",
+			strings.TrimPrefix(core.Name, "cpu"),
+			escBrightWhite, barWidth, strings.Repeat("|", n), escReset, busy)
+	}
+	if len(cores) > 0 {
+		buf.WriteString("\n")
+	}
+	return buf.String()
 }
 
 const (
@@ -0,0 +1,174 @@
+/*
+
+rtop - the remote system monitoring utility
+
+Copyright (c) 2015 RapidLoop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+)
+
+type ProcInfo struct {
+	PID     int
+	User    string
+	State   string
+	CPU     float32 // percent of one core
+	RSS     uint64
+	Command string
+}
+
+// procsCommand dumps the stat, the uid and RSS from status, and the command
+// line of every process, all in one go rather than per process.
+const procsCommand = "/bin/cat /proc/[0-9]*/stat; " +
+	"grep -s -H -e '^Uid:' -e '^VmRSS:' /proc/[0-9]*/status; " +
+	"head -c 512 /proc/[0-9]*/cmdline | tr '\\0' ' '"
+
+// the user names by uid, from the remote's /etc/passwd
+var userNames = make(map[string]string)
+
+func parseUsers(lines string, stats *Stats) (err error) {
+	scanner := bufio.NewScanner(strings.NewReader(lines))
+	for scanner.Scan() {
+		parts := strings.Split(scanner.Text(), ":")
+		if len(parts) >= 3 {
+			userNames[parts[2]] = parts[0]
+		}
+	}
+	return
+}
+
+type procRaw struct {
+	start uint64 // start time, to tell a reused pid apart
+	ticks uint64 // user and system time
+}
+
+var (
+	// the process times that were fetched last time round
+	preProcs = make(map[int]procRaw)
+	// the ticks each core has been through since the last refresh, set by
+	// parseCPU
+	cpuTicks float64
+)
+
+// pidOf returns the pid in a path like /proc/123/status.
+func pidOf(path string) (pid int, ok bool) {
+	path = strings.TrimPrefix(path, "/proc/")
+	if i := strings.Index(path, "/"); i != -1 {
+		if pid, err := strconv.Atoi(path[:i]); err == nil {
+			return pid, true
+		}
+	}
+	return
+}
+
+func parseProcs(lines string, stats *Stats) (err error) {
+	procs := make(map[int]*ProcInfo)
+	nowProcs := make(map[int]procRaw)
+	cmdPID := -1
+	scanner := bufio.NewScanner(strings.NewReader(lines))
+	for scanner.Scan() {
+		line := scanner.Text()
+		// the header head puts before each file
+		if strings.HasPrefix(line, "==> ") && strings.HasSuffix(line, " <==") {
+			cmdPID, _ = pidOf(line[4 : len(line)-4])
+			continue
+		}
+		// the command lines come last; kernel threads have none and keep
+		// [comm]
+		if cmdPID != -1 {
+			if cmd := strings.TrimSpace(line); len(cmd) > 0 && procs[cmdPID] != nil {
+				if strings.HasPrefix(procs[cmdPID].Command, "[") {
+					procs[cmdPID].Command = cmd
+				} else {
+					procs[cmdPID].Command += " " + cmd
+				}
+			}
+			continue
+		}
+		// status, as file:key:\tvalue
+		if strings.HasPrefix(line, "/proc/") {
+			pid, ok := pidOf(line)
+			parts := strings.SplitN(line, ":", 3)
+			if !ok || len(parts) < 3 || procs[pid] == nil {
+				continue
+			}
+			fields := strings.Fields(parts[2])
+			if len(fields) == 0 {
+				continue
+			}
+			switch parts[1] {
+			case "Uid":
+				// the effective uid
+				uid := fields[0]
+				if len(fields) > 1 {
+					uid = fields[1]
+				}
+				if name, ok := userNames[uid]; ok {
+					procs[pid].User = name
+				} else {
+					procs[pid].User = uid
+				}
+			case "VmRSS":
+				if rss, err := strconv.ParseUint(fields[0], 10, 64); err == nil {
+					procs[pid].RSS = rss * 1024
+				}
+			}
+			continue
+		}
+		// pid (comm) state ppid ..., where comm can contain anything
+		open, end := strings.Index(line, " ("), strings.LastIndex(line, ")")
+		if open != -1 && end > open {
+			if pid, err := strconv.Atoi(line[:open]); err == nil {
+				fields := strings.Fields(line[end+1:])
+				if len(fields) < 20 {
+					continue
+				}
+				info := &ProcInfo{
+					PID:     pid,
+					State:   fields[0],
+					Command: "[" + line[open+2:end] + "]",
+				}
+				utime, _ := strconv.ParseUint(fields[11], 10, 64)
+				stime, _ := strconv.ParseUint(fields[12], 10, 64)
+				start, _ := strconv.ParseUint(fields[19], 10, 64)
+				now := procRaw{start, utime + stime}
+				if pre, ok := preProcs[pid]; ok && pre.start == now.start &&
+					now.ticks >= pre.ticks && cpuTicks > 0 {
+					info.CPU = float32(float64(now.ticks-pre.ticks) / cpuTicks * 100)
+				}
+				nowProcs[pid] = now
+				procs[pid] = info
+				continue
+			}
+		}
+	}
+
+	for _, info := range procs {
+		stats.Procs = append(stats.Procs, *info)
+	}
+	preProcs = nowProcs
+	return
+}
@@ -0,0 +1,90 @@
+/*
+
+rtop - the remote system monitoring utility
+
+Copyright (c) 2015 RapidLoop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// proxyConn is a connection over the stdin and stdout of a ProxyCommand.
+type proxyConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	addr   proxyAddr
+}
+
+// proxyAddr stands in for the remote address, which only the proxy knows.
+type proxyAddr string
+
+func (a proxyAddr) Network() string { return "proxy" }
+func (a proxyAddr) String() string  { return string(a) }
+
+func (c *proxyConn) Read(b []byte) (int, error)  { return c.stdout.Read(b) }
+func (c *proxyConn) Write(b []byte) (int, error) { return c.stdin.Write(b) }
+
+func (c *proxyConn) Close() error {
+	c.stdin.Close()
+	c.stdout.Close()
+	if c.cmd.Process != nil {
+		c.cmd.Process.Kill()
+	}
+	return c.cmd.Wait()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr                { return proxyAddr("proxy") }
+func (c *proxyConn) RemoteAddr() net.Addr               { return c.addr }
+func (c *proxyConn) SetDeadline(t time.Time) error      { return nil }
+func (c *proxyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *proxyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// dialProxyCommand runs the ProxyCommand for s, and returns a connection
+// over its stdin and stdout.
+func dialProxyCommand(s *Section) (net.Conn, error) {
+	debugf("executing proxy command: %s", s.ProxyCommand)
+
+	cmd := shellCommand(s.ProxyCommand)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	addr := net.JoinHostPort(s.Hostname, strconv.Itoa(s.Port))
+	return &proxyConn{cmd, stdin, stdout, proxyAddr(addr)}, nil
+}
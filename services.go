@@ -0,0 +1,108 @@
+/*
+
+rtop - the remote system monitoring utility
+
+Copyright (c) 2015 RapidLoop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+)
+
+type UnitInfo struct {
+	Name   string
+	Load   string // loaded, not-found ...
+	Active string // active, failed, inactive ...
+	Sub    string // running, exited, dead ...
+}
+
+// servicesCommand lists the failed units, and the state of the units to be
+// watched, if there are any. Nothing is output unless systemd is running,
+// which it is if /run/systemd/system exists (see sd_booted(3)).
+func servicesCommand(watch []string) string {
+	var cmd bytes.Buffer
+	cmd.WriteString("[ -d /run/systemd/system ] && { echo systemd; " +
+		"systemctl list-units --failed --plain --no-legend --no-pager")
+	if len(watch) > 0 {
+		cmd.WriteString("; echo; systemctl show -p Id -p LoadState -p ActiveState -p SubState --")
+		for _, unit := range watch {
+			cmd.WriteString(" '" + strings.Replace(unit, "'", `'\''`, -1) + "'")
+		}
+	}
+	cmd.WriteString("; }")
+	return cmd.String()
+}
+
+// watchServices makes the services collector also report on these units.
+func watchServices(units []string) {
+	for i := range collectors {
+		if collectors[i].name == "services" {
+			collectors[i].command = servicesCommand(units)
+		}
+	}
+}
+
+func parseServices(lines string, stats *Stats) (err error) {
+	var unit *UnitInfo
+	scanner := bufio.NewScanner(strings.NewReader(lines))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "systemd" {
+			stats.Systemd = true
+			continue
+		}
+		// systemctl show: Key=value lines, a blank line after each unit
+		if i := strings.Index(line, "="); i != -1 && !strings.Contains(line[:i], " ") {
+			if unit == nil {
+				stats.WatchedUnits = append(stats.WatchedUnits, UnitInfo{})
+				unit = &stats.WatchedUnits[len(stats.WatchedUnits)-1]
+			}
+			switch key, value := line[:i], line[i+1:]; key {
+			case "Id":
+				unit.Name = value
+			case "LoadState":
+				unit.Load = value
+			case "ActiveState":
+				unit.Active = value
+			case "SubState":
+				unit.Sub = value
+			}
+			continue
+		}
+		if len(line) == 0 {
+			unit = nil
+			continue
+		}
+		// list-units: unit load active sub description
+		fields := strings.Fields(strings.TrimPrefix(line, "●"))
+		if len(fields) >= 4 {
+			stats.FailedUnits = append(stats.FailedUnits, UnitInfo{
+				fields[0], fields[1], fields[2], fields[3],
+			})
+		}
+	}
+
+	return
+}
@@ -0,0 +1,189 @@
+/*
+
+rtop - the remote system monitoring utility
+
+Copyright (c) 2015 RapidLoop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ListenInfo struct {
+	Proto string // tcp, tcp6, udp, udp6
+	Addr  string
+	Port  int
+}
+
+type NetCounter struct {
+	Name  string  // as in /proc/net/snmp or netstat, e.g. Tcp.RetransSegs
+	Value uint64  // since boot
+	Rate  float64 // per second
+}
+
+// socketsCommand counts the sockets by protocol and state, and lists the
+// listening ones. Busy hosts have far too many sockets to send them all
+// over each time round, so awk sums them up on the remote.
+const socketsCommand = "awk 'FNR > 1 { n[FILENAME \" \" $4]++ } " +
+	"FNR > 1 && ($4 == \"0A\" && FILENAME ~ /tcp/ || $4 == \"07\" && FILENAME ~ /udp/) " +
+	"{ print \"listen\", FILENAME, $2 } " +
+	"END { for (k in n) print \"state\", k, n[k] }' " +
+	"/proc/net/tcp /proc/net/tcp6 /proc/net/udp /proc/net/udp6"
+
+// the TCP states, as in include/net/tcp_states.h
+var tcpStates = []string{
+	"", "established", "syn_sent", "syn_recv", "fin_wait1", "fin_wait2",
+	"time_wait", "close", "close_wait", "last_ack", "listen", "closing",
+}
+
+// parseSockAddr decodes an address like 0100007F:0016, where the IP address
+// is in host byte order, 32 bits at a time.
+func parseSockAddr(s string) (addr string, port int, ok bool) {
+	i := strings.Index(s, ":")
+	if i == -1 {
+		return
+	}
+	ip, err := hex.DecodeString(s[:i])
+	if err != nil || (len(ip) != net.IPv4len && len(ip) != net.IPv6len) {
+		return
+	}
+	for j := 0; j < len(ip); j += 4 {
+		ip[j], ip[j+1], ip[j+2], ip[j+3] = ip[j+3], ip[j+2], ip[j+1], ip[j]
+	}
+	p, err := strconv.ParseUint(s[i+1:], 16, 16)
+	if err != nil {
+		return
+	}
+	return net.IP(ip).String(), int(p), true
+}
+
+func parseSockets(lines string, stats *Stats) (err error) {
+	scanner := bufio.NewScanner(strings.NewReader(lines))
+	for scanner.Scan() {
+		parts := strings.Fields(scanner.Text())
+		if len(parts) < 3 {
+			continue
+		}
+		proto := strings.TrimPrefix(parts[1], "/proc/net/")
+		switch {
+		case parts[0] == "listen":
+			if addr, port, ok := parseSockAddr(parts[2]); ok {
+				stats.Listening = append(stats.Listening, ListenInfo{proto, addr, port})
+			}
+		case parts[0] == "state" && len(parts) == 4:
+			n, err := strconv.Atoi(parts[3])
+			if err != nil {
+				continue
+			}
+			if strings.HasPrefix(proto, "udp") {
+				stats.UDPSockets += n
+				continue
+			}
+			state, err := strconv.ParseUint(parts[2], 16, 8)
+			if err != nil || int(state) >= len(tcpStates) || state == 0 {
+				continue
+			}
+			if stats.TCPStates == nil {
+				stats.TCPStates = make(map[string]int)
+			}
+			stats.TCPStates[tcpStates[state]] += n
+		}
+	}
+
+	return
+}
+
+// the counters from /proc/net/snmp and /proc/net/netstat that are shown
+var netCounters = []string{
+	"Tcp.ActiveOpens",
+	"Tcp.PassiveOpens",
+	"Tcp.AttemptFails",
+	"Tcp.EstabResets",
+	"Tcp.RetransSegs",
+	"Tcp.InErrs",
+	"Tcp.OutRsts",
+	"TcpExt.ListenOverflows",
+	"TcpExt.ListenDrops",
+	"TcpExt.TCPTimeouts",
+	"Udp.InDatagrams",
+	"Udp.OutDatagrams",
+	"Udp.NoPorts",
+	"Udp.InErrors",
+	"Udp.RcvbufErrors",
+	"Udp.SndbufErrors",
+}
+
+// the counters that were fetched last time round, and the uptime then
+var (
+	preNetCounters       = make(map[string]uint64)
+	preNetCountersUptime time.Duration
+)
+
+func parseNetCounters(lines string, stats *Stats) (err error) {
+	// each group is a line of names followed by a line of values
+	values := make(map[string]uint64)
+	var names []string
+	scanner := bufio.NewScanner(strings.NewReader(lines))
+	for scanner.Scan() {
+		parts := strings.Fields(scanner.Text())
+		if len(parts) < 2 {
+			continue
+		}
+		group := strings.TrimSuffix(parts[0], ":")
+		if _, err := strconv.ParseInt(parts[1], 10, 64); err != nil {
+			names = parts[1:]
+			continue
+		}
+		for i, val := range parts[1:] {
+			if i >= len(names) {
+				break
+			}
+			if v, err := strconv.ParseUint(val, 10, 64); err == nil {
+				values[group+"."+names[i]] = v
+			}
+		}
+		names = nil
+	}
+
+	elapsed := (stats.Uptime - preNetCountersUptime).Seconds()
+	for _, name := range netCounters {
+		val, ok := values[name]
+		if !ok {
+			continue
+		}
+		counter := NetCounter{Name: name, Value: val}
+		if pre, ok := preNetCounters[name]; ok && elapsed > 0 && val >= pre {
+			counter.Rate = float64(val-pre) / elapsed
+		}
+		stats.NetCounters = append(stats.NetCounters, counter)
+	}
+
+	preNetCounters = values
+	preNetCountersUptime = stats.Uptime
+	return
+}
@@ -27,123 +27,513 @@ package main
 
 import (
 	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
 	"log"
 	"os"
-	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
 
+// Section holds the settings for connecting to one host, as resolved from
+// the ssh config files.
 type Section struct {
-	Hostname     string
-	Port         int
-	User         string
-	IdentityFile string
+	Host                     string // the name as given by the user
+	Hostname                 string
+	Port                     int
+	User                     string
+	IdentityFile             []string
+	IdentitiesOnly           string
+	CertificateFile          []string
+	StrictHostKeyChecking    string
+	UserKnownHostsFile       []string
+	PreferredAuthentications string
+	ProxyJump                string
+	ProxyCommand             string
+	ConnectTimeout           string
+	ServerAliveInterval      string
+	ServerAliveCountMax      string
 }
 
-func (s *Section) clear() {
-	s.Hostname = ""
-	s.Port = 0
-	s.User = ""
-	s.IdentityFile = ""
+// configLine is a keyword and its arguments from an ssh config file.
+type configLine struct {
+	file    string
+	line    int
+	keyword string       // in lower case
+	args    []string     // unquoted arguments
+	rest    string       // the raw text after the keyword, for ProxyCommand
+	include []configLine // for Include, the lines of the included files
 }
 
-func (s *Section) getFull(name string, def Section) (host string, port int, user, keyfile string) {
-	if len(s.Hostname) > 0 {
-		host = s.Hostname
-	} else if len(def.Hostname) > 0 {
-		host = def.Hostname
+// the lines of all the ssh config files read, in order
+var configLines []configLine
+
+// maxIncludeDepth limits nested Include directives, as in ssh.
+const maxIncludeDepth = 16
+
+// apply sets the option from l in s. Like ssh, the first value obtained
+// for an option wins, except for those that accumulate.
+func (s *Section) apply(l *configLine, set map[string]bool) {
+	if len(l.args) == 0 {
+		return
+	}
+	if l.keyword != "identityfile" && l.keyword != "certificatefile" {
+		if set[l.keyword] {
+			return
+		}
+		set[l.keyword] = true
 	}
-	if s.Port > 0 {
-		port = s.Port
-	} else if def.Port > 0 {
-		port = def.Port
+
+	switch l.keyword {
+	case "hostname":
+		s.Hostname = l.args[0]
+	case "port":
+		if p, err := strconv.Atoi(l.args[0]); err == nil {
+			s.Port = p
+		}
+	case "user":
+		s.User = l.args[0]
+	case "identityfile":
+		if !contains(s.IdentityFile, l.args[0]) {
+			s.IdentityFile = append(s.IdentityFile, l.args[0])
+		}
+	case "identitiesonly":
+		s.IdentitiesOnly = l.args[0]
+	case "certificatefile":
+		if !contains(s.CertificateFile, l.args[0]) {
+			s.CertificateFile = append(s.CertificateFile, l.args[0])
+		}
+	case "preferredauthentications":
+		s.PreferredAuthentications = l.args[0]
+	case "proxyjump":
+		s.ProxyJump = l.args[0]
+	case "proxycommand":
+		s.ProxyCommand = l.rest
+	case "stricthostkeychecking":
+		s.StrictHostKeyChecking = l.args[0]
+	case "userknownhostsfile":
+		s.UserKnownHostsFile = l.args
+	case "connecttimeout":
+		s.ConnectTimeout = l.args[0]
+	case "serveraliveinterval":
+		s.ServerAliveInterval = l.args[0]
+	case "serveralivecountmax":
+		s.ServerAliveCountMax = l.args[0]
+	}
+}
+
+// matchPattern matches s against a pattern with * and ? wildcards.
+func matchPattern(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := 0; i <= len(s); i++ {
+				if matchPattern(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
 	}
-	if len(s.User) > 0 {
-		user = s.User
-	} else if len(def.User) > 0 {
-		user = def.User
+	return len(s) == 0
+}
+
+// matchPatterns reports whether s matches any of the patterns, and none of
+// the negated (!pattern) ones.
+func matchPatterns(patterns []string, s string, fold bool) (ok bool) {
+	if fold {
+		s = strings.ToLower(s)
 	}
-	if len(s.IdentityFile) > 0 {
-		keyfile = s.IdentityFile
-	} else if len(def.IdentityFile) > 0 {
-		keyfile = def.IdentityFile
+	for _, p := range patterns {
+		if fold {
+			p = strings.ToLower(p)
+		}
+		if strings.HasPrefix(p, "!") {
+			if matchPattern(p[1:], s) {
+				return false
+			}
+		} else if matchPattern(p, s) {
+			ok = true
+		}
 	}
 	return
 }
 
-var HostInfo = make(map[string]Section)
+// configMatcher evaluates the config lines for one host.
+type configMatcher struct {
+	name string // the host as given by the user
+	user string // the remote user, if given on the command line
+	s    Section
+	set  map[string]bool
+}
+
+// host is the HostName in effect so far, with %h expanded as ssh does
+// before evaluating Match, or else the name as given.
+func (m *configMatcher) host() string {
+	if len(m.s.Hostname) > 0 {
+		return expandHostname(m.s.Hostname, m.name)
+	}
+	return m.name
+}
 
-func getSshEntry(name string) (host string, port int, user, keyfile string) {
+// expandHostname expands the only tokens allowed in HostName, %% and %h.
+func expandHostname(hostname, host string) string {
+	return strings.NewReplacer("%%", "%", "%h", host).Replace(hostname)
+}
 
-	def := Section{Hostname: name}
-	if defcfg, ok := HostInfo["*"]; ok {
-		def = defcfg
+func (m *configMatcher) remoteUser() string {
+	if len(m.user) > 0 {
+		return m.user
 	}
+	if len(m.s.User) > 0 {
+		return m.s.User
+	}
+	return currentUser.Username
+}
 
-	if s, ok := HostInfo[name]; ok {
-		return s.getFull(name, def)
+// eval applies the lines in order, tracking which ones are in effect. The
+// lines before the first Host or Match apply to all hosts.
+func (m *configMatcher) eval(lines []configLine, active bool) {
+	for i := range lines {
+		l := &lines[i]
+		switch l.keyword {
+		case "host":
+			active = matchPatterns(l.args, m.name, true)
+		case "match":
+			active = m.match(l)
+		case "include":
+			if active {
+				m.eval(l.include, active)
+			}
+		default:
+			if active {
+				m.s.apply(l, m.set)
+			}
+		}
 	}
-	for h, s := range HostInfo {
-		if ok, err := path.Match(h, name); ok && err == nil {
-			return s.getFull(name, def)
+}
+
+// match evaluates the criteria of a Match line.
+func (m *configMatcher) match(l *configLine) bool {
+	args := l.args
+	for i := 0; i < len(args); i++ {
+		criterion := strings.ToLower(args[i])
+		negate := strings.HasPrefix(criterion, "!")
+		criterion = strings.TrimPrefix(criterion, "!")
+
+		var ok bool
+		switch criterion {
+		case "all", "final":
+			// there is no separate final pass, this is it
+			ok = true
+		case "canonical":
+			ok = false
+		case "host", "originalhost", "user", "localuser", "exec":
+			if i+1 >= len(args) {
+				warnMatch(l, "missing argument for Match %s", criterion)
+				return false
+			}
+			i++
+			patterns := strings.Split(args[i], ",")
+			switch criterion {
+			case "host":
+				ok = matchPatterns(patterns, m.host(), true)
+			case "originalhost":
+				ok = matchPatterns(patterns, m.name, true)
+			case "user":
+				ok = matchPatterns(patterns, m.remoteUser(), false)
+			case "localuser":
+				ok = matchPatterns(patterns, currentUser.Username, false)
+			case "exec":
+				ok = m.exec(args[i])
+			}
+		default:
+			warnMatch(l, "unsupported Match criterion %q", args[i])
+			return false
+		}
+		if ok == negate {
+			return false
 		}
 	}
-	return def.Hostname, def.Port, def.User, def.IdentityFile
+	return len(args) > 0
 }
 
-func parseSshConfig(path string) bool {
+// the warnings already logged about Match lines
+var matchWarnings = make(map[string]bool)
+
+// warnMatch logs a problem with a Match line, once only, since the lines
+// are evaluated again for every host looked up.
+func warnMatch(l *configLine, format string, args ...interface{}) {
+	msg := fmt.Sprintf("warning: %s:%d: ", l.file, l.line) + fmt.Sprintf(format, args...)
+	if !matchWarnings[msg] {
+		matchWarnings[msg] = true
+		log.Print(msg)
+	}
+}
+
+// exec runs the command of a Match exec, which matches if it succeeds.
+func (m *configMatcher) exec(command string) bool {
+	s := m.s
+	s.Hostname = m.host()
+	s.User = m.remoteUser()
+	if s.Port == 0 {
+		s.Port = 22
+	}
+	command = expandTokens(command, &s)
+	cmd := shellCommand(command)
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	debugf("Match exec %q: %v", command, err)
+	return err == nil
+}
+
+// connectionHash is the value of the %C token, a hash of %l%h%p%r.
+func connectionHash(s *Section) string {
+	local, _ := os.Hostname()
+	sum := sha1.Sum([]byte(local + s.Hostname + strconv.Itoa(s.Port) + s.User))
+	return hex.EncodeToString(sum[:])
+}
+
+// expandTokens replaces the % tokens described in ssh_config(5) in a config
+// value.
+func expandTokens(value string, s *Section) string {
+	var out []byte
+	for i := 0; i < len(value); i++ {
+		if value[i] != '%' || i+1 == len(value) {
+			out = append(out, value[i])
+			continue
+		}
+		i++
+		switch value[i] {
+		case '%':
+			out = append(out, '%')
+		case 'C':
+			out = append(out, connectionHash(s)...)
+		case 'd':
+			out = append(out, currentUser.HomeDir...)
+		case 'h':
+			out = append(out, s.Hostname...)
+		case 'i':
+			out = append(out, strconv.Itoa(os.Getuid())...)
+		case 'j':
+			out = append(out, s.ProxyJump...)
+		case 'k', 'n':
+			out = append(out, s.Host...)
+		case 'L':
+			local, _ := os.Hostname()
+			if dot := strings.Index(local, "."); dot != -1 {
+				local = local[:dot]
+			}
+			out = append(out, local...)
+		case 'l':
+			local, _ := os.Hostname()
+			out = append(out, local...)
+		case 'p':
+			out = append(out, strconv.Itoa(s.Port)...)
+		case 'r':
+			out = append(out, s.User...)
+		case 'u':
+			out = append(out, currentUser.Username...)
+		default:
+			log.Printf("warning: unknown token %%%c in %q", value[i], value)
+			out = append(out, '%', value[i])
+		}
+	}
+	return string(out)
+}
+
+// expandEnv replaces ${NAME} in a config value with the value of the
+// environment variable NAME.
+func expandEnv(value string) string {
+	var out string
+	for {
+		i := strings.Index(value, "${")
+		if i == -1 {
+			break
+		}
+		j := strings.Index(value[i:], "}")
+		if j == -1 {
+			break
+		}
+		name := value[i+2 : i+j]
+		env, ok := os.LookupEnv(name)
+		if !ok {
+			log.Printf("warning: environment variable %s is not set, in %q", name, value)
+		}
+		out += value[:i] + env
+		value = value[i+j+1:]
+	}
+	return out + value
+}
+
+func expandAll(values []string, s *Section) (expanded []string) {
+	for _, v := range values {
+		expanded = append(expanded, expandEnv(expandTokens(v, s)))
+	}
+	return
+}
+
+// getSshEntry returns the settings from the ssh config files for the host
+// name, connecting as user (which may be empty).
+func getSshEntry(name, user string) Section {
+	m := configMatcher{name: name, user: user, set: make(map[string]bool)}
+	m.s.Host = name
+	m.eval(configLines, true)
+	return m.s
+}
+
+// getHostConfig returns the settings for connecting to host, from the ssh
+// config and the defaults. The port, user and keys, as given on the command
+// line, take precedence.
+func getHostConfig(host string, port int, user string, keys []string) Section {
+	s := getSshEntry(host, user)
+	if len(s.Hostname) == 0 {
+		s.Hostname = host
+	} else {
+		s.Hostname = expandHostname(s.Hostname, host)
+	}
+	if port != 0 {
+		s.Port = port
+	} else if s.Port == 0 {
+		s.Port = 22
+	}
+	if len(user) > 0 {
+		s.User = user
+	} else if len(s.User) == 0 {
+		s.User = currentUser.Username
+	}
+	// like ssh, try keys from the command line first
+	s.IdentityFile = append(keys[:len(keys):len(keys)], s.IdentityFile...)
+	if len(s.IdentityFile) == 0 {
+		s.IdentityFile = getDefaultIdentities()
+	}
+
+	// expand tokens, now that the host, port and user are known
+	s.IdentityFile = expandAll(s.IdentityFile, &s)
+	s.CertificateFile = expandAll(s.CertificateFile, &s)
+	s.UserKnownHostsFile = expandAll(s.UserKnownHostsFile, &s)
+	s.ProxyCommand = expandTokens(s.ProxyCommand, &s)
+	s.ProxyJump = expandTokens(s.ProxyJump, &s)
+	return s
+}
+
+// splitArgs splits the arguments of a config line into words. Double
+// quotes group words together, and an unquoted # starts a comment.
+func splitArgs(text string) (args []string, err error) {
+	var word []byte
+	inWord, quoted := false, false
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quoted && c == '"':
+			quoted = false
+		case quoted:
+			word = append(word, c)
+		case c == '"':
+			quoted, inWord = true, true
+		case c == ' ' || c == '\t':
+			if inWord {
+				args = append(args, string(word))
+				word, inWord = word[:0], false
+			}
+		case c == '#' && !inWord:
+			return
+		default:
+			word = append(word, c)
+			inWord = true
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if inWord {
+		args = append(args, string(word))
+	}
+	return
+}
+
+// parseConfigLine parses "Keyword args" or "Keyword=args".
+func parseConfigLine(text string) (l configLine, err error) {
+	i := strings.IndexAny(text, " \t=")
+	if i == -1 {
+		i = len(text)
+	}
+	l.keyword = strings.ToLower(text[:i])
+	rest := strings.TrimLeft(text[i:], " \t")
+	if strings.HasPrefix(rest, "=") {
+		rest = strings.TrimLeft(rest[1:], " \t")
+	}
+	l.rest = rest
+	l.args, err = splitArgs(rest)
+	return
+}
+
+// readConfigFile returns the lines of an ssh config file, with the files
+// it includes read in too. Relative includes are looked up in dir.
+func readConfigFile(path, dir string, depth int) (lines []configLine, err error) {
 	f, err := os.Open(path)
 	if err != nil {
-		log.Printf("warning: %v", err)
-		return false
+		return
 	}
 	defer f.Close()
-	update := func(cb func(s *Section)) {}
+
 	s := bufio.NewScanner(f)
-	for s.Scan() {
-		line := strings.TrimSpace(s.Text())
-		if len(line) == 0 || line[0] == '#' {
+	for n := 1; s.Scan(); n++ {
+		text := strings.TrimSpace(s.Text())
+		if len(text) == 0 || text[0] == '#' {
 			continue
 		}
-		parts := strings.Fields(line)
-		if len(parts) > 1 && strings.ToLower(parts[0]) == "host" {
-			hosts := parts[1:]
-			for _, h := range hosts {
-				if _, ok := HostInfo[h]; !ok {
-					HostInfo[h] = Section{}
-				}
+		l, err := parseConfigLine(text)
+		if err != nil {
+			log.Printf("warning: %s:%d: %v", path, n, err)
+			continue
+		}
+		l.file, l.line = path, n
+		if l.keyword == "include" {
+			if depth >= maxIncludeDepth {
+				log.Printf("warning: %s:%d: too many nested includes", path, n)
+				continue
 			}
-			update = func(cb func(s *Section)) {
-				for _, h := range hosts {
-					s, _ := HostInfo[h]
-					cb(&s)
-					HostInfo[h] = s
+			for _, arg := range l.args {
+				pattern := expandPath(arg)
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(dir, pattern)
 				}
-			}
-		}
-		if len(parts) == 2 {
-			switch strings.ToLower(parts[0]) {
-			case "hostname":
-				update(func(s *Section) {
-					s.Hostname = parts[1]
-				})
-			case "port":
-				if p, err := strconv.Atoi(parts[1]); err == nil {
-					update(func(s *Section) {
-						s.Port = p
-					})
+				matches, _ := filepath.Glob(pattern)
+				for _, match := range matches {
+					included, err := readConfigFile(match, dir, depth+1)
+					if err != nil {
+						log.Printf("warning: %s:%d: %v", path, n, err)
+						continue
+					}
+					l.include = append(l.include, included...)
 				}
-			case "user":
-				update(func(s *Section) {
-					s.User = parts[1]
-				})
-			case "identityfile":
-				update(func(s *Section) {
-					s.IdentityFile = parts[1]
-				})
 			}
 		}
+		lines = append(lines, l)
+	}
+	return lines, s.Err()
+}
+
+// parseSshConfig reads an ssh config file. Values from files read earlier
+// take precedence.
+func parseSshConfig(path string) bool {
+	lines, err := readConfigFile(path, filepath.Dir(path), 0)
+	if err != nil {
+		log.Printf("warning: %v", err)
+		return false
 	}
+	configLines = append(configLines, lines...)
 	return true
 }
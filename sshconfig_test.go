@@ -0,0 +1,388 @@
+/*
+
+rtop - the remote system monitoring utility
+
+Copyright (c) 2015 RapidLoop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// setupConfig makes the given text the only ssh config read, as a file in a
+// temporary directory, and returns that directory.
+func setupConfig(t *testing.T, text string) string {
+	t.Helper()
+	dir := t.TempDir()
+	currentUser = &user.User{Username: "me", HomeDir: dir}
+	path := filepath.Join(dir, "config")
+	if err := os.WriteFile(path, []byte(text), 0600); err != nil {
+		t.Fatal(err)
+	}
+	configLines = nil
+	if !parseSshConfig(path) {
+		t.Fatalf("parseSshConfig(%q) failed", path)
+	}
+	t.Cleanup(func() { configLines = nil })
+	return dir
+}
+
+func TestMatchHostExpandsHostname(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   string // the User that ends up set
+	}{
+		{
+			"match host sees %h expanded",
+			"Host web\n  HostName %h.example.com\n" +
+				"Match host web.example.com\n  User expanded\n" +
+				"Match host %h.example.com\n  User literal\n",
+			"expanded",
+		},
+		{
+			"%% is a literal percent",
+			"Host web\n  HostName %%h.example.com\n" +
+				"Match host %h.example.com\n  User literal\n",
+			"literal",
+		},
+		{
+			"match exec sees %h expanded",
+			"Host web\n  HostName %h.example.com\n" +
+				"Match exec \"test %h = web.example.com\"\n  User expanded\n",
+			"expanded",
+		},
+		{
+			"no HostName matches the name as given",
+			"Match host web\n  User plain\n",
+			"plain",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupConfig(t, tt.config)
+			if got := getSshEntry("web", "").User; got != tt.want {
+				t.Errorf("User = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetHostConfigExpandsHostname(t *testing.T) {
+	setupConfig(t, "Host web\n  HostName %h.example.com\n")
+	s := getHostConfig("web", 0, "", nil)
+	if s.Hostname != "web.example.com" {
+		t.Errorf("Hostname = %q, want %q", s.Hostname, "web.example.com")
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"web", "web", true},
+		{"web", "web1", false},
+		{"web*", "web", true},
+		{"web*", "web1.example.com", true},
+		{"*.example.com", "web.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"web?", "web1", true},
+		{"web?", "web", false},
+		{"w*b?", "wxxb1", true},
+		{"*", "", true},
+		{"", "", true},
+		{"", "web", false},
+	}
+	for _, tt := range tests {
+		if got := matchPattern(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("matchPattern(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestMatchPatterns(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		s        string
+		fold     bool
+		want     bool
+	}{
+		{[]string{"web", "db"}, "db", false, true},
+		{[]string{"web", "db"}, "cache", false, false},
+		{[]string{"*", "!db"}, "web", false, true},
+		{[]string{"*", "!db"}, "db", false, false},
+		{[]string{"!db", "*"}, "db", false, false},
+		{[]string{"!db"}, "web", false, false}, // a negation alone never matches
+		{[]string{"WEB"}, "web", false, false},
+		{[]string{"WEB"}, "web", true, true},
+		{[]string{"*", "!DB"}, "db", true, false},
+	}
+	for _, tt := range tests {
+		if got := matchPatterns(tt.patterns, tt.s, tt.fold); got != tt.want {
+			t.Errorf("matchPatterns(%q, %q, %v) = %v, want %v", tt.patterns, tt.s, tt.fold, got, tt.want)
+		}
+	}
+}
+
+func TestParseConfigLine(t *testing.T) {
+	tests := []struct {
+		text    string
+		keyword string
+		args    []string
+		rest    string
+		err     bool
+	}{
+		{"User alice", "user", []string{"alice"}, "alice", false},
+		{"User=alice", "user", []string{"alice"}, "alice", false},
+		{"User = alice", "user", []string{"alice"}, "alice", false},
+		{"User\t=\talice", "user", []string{"alice"}, "alice", false},
+		{"HOSTNAME example.com", "hostname", []string{"example.com"}, "example.com", false},
+		{"IdentityFile \"~/my keys/id\"", "identityfile", []string{"~/my keys/id"}, "\"~/my keys/id\"", false},
+		{"Host a\"b c\"d e", "host", []string{"ab cd", "e"}, "a\"b c\"d e", false},
+		{"Host \"\"", "host", []string{""}, "\"\"", false},
+		{"Host web # comment", "host", []string{"web"}, "web # comment", false},
+		{"Host web#1", "host", []string{"web#1"}, "web#1", false},
+		{"Host \"#web\"", "host", []string{"#web"}, "\"#web\"", false},
+		{"ProxyCommand nc  %h %p", "proxycommand", []string{"nc", "%h", "%p"}, "nc  %h %p", false},
+		{"Compression", "compression", nil, "", false},
+		{"IdentityFile \"unterminated", "identityfile", nil, "\"unterminated", true},
+	}
+	for _, tt := range tests {
+		l, err := parseConfigLine(tt.text)
+		if (err != nil) != tt.err {
+			t.Errorf("parseConfigLine(%q) error = %v, want error %v", tt.text, err, tt.err)
+			continue
+		}
+		if l.keyword != tt.keyword || !reflect.DeepEqual(l.args, tt.args) || l.rest != tt.rest {
+			t.Errorf("parseConfigLine(%q) = %q %q %q, want %q %q %q", tt.text,
+				l.keyword, l.args, l.rest, tt.keyword, tt.args, tt.rest)
+		}
+	}
+}
+
+func TestGetSshEntry(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		host   string
+		user   string // as on the command line
+		want   Section
+	}{
+		{
+			"first value wins",
+			"Host web\n  User first\n  Port 2222\n" +
+				"Host *\n  User second\n  Port 22\n  HostName example.com\n",
+			"web", "",
+			Section{Host: "web", User: "first", Port: 2222, Hostname: "example.com"},
+		},
+		{
+			"lines before any Host apply to all",
+			"User global\nHost web\n  User web\n",
+			"web", "",
+			Section{Host: "web", User: "global"},
+		},
+		{
+			"identity files accumulate",
+			"Host web\n  IdentityFile a\n  IdentityFile b\n" +
+				"Host *\n  IdentityFile a\n  IdentityFile c\n",
+			"web", "",
+			Section{Host: "web", IdentityFile: []string{"a", "b", "c"}},
+		},
+		{
+			"Host patterns and case",
+			"Host db *.EXAMPLE.com\n  User matched\n",
+			"web.example.com", "",
+			Section{Host: "web.example.com", User: "matched"},
+		},
+		{
+			"Host negation",
+			"Host * !web\n  User notweb\nHost *\n  User other\n",
+			"web", "",
+			Section{Host: "web", User: "other"},
+		},
+		{
+			"Key=value",
+			"Host=web\n  User=alice\n  Port = 2200\n",
+			"web", "",
+			Section{Host: "web", User: "alice", Port: 2200},
+		},
+		{
+			"quoted arguments",
+			"Host \"web\"\n  IdentityFile \"~/my keys/id\"\n  UserKnownHostsFile \"a b\" c\n",
+			"web", "",
+			Section{Host: "web", IdentityFile: []string{"~/my keys/id"}, UserKnownHostsFile: []string{"a b", "c"}},
+		},
+		{
+			"comments",
+			"# User commented\nHost web # the web server\n  User alice # not bob\n",
+			"web", "",
+			Section{Host: "web", User: "alice"},
+		},
+		{
+			"ProxyCommand keeps the raw text",
+			"Host web\n  ProxyCommand ssh -W \"%h:%p\"  jump\n",
+			"web", "",
+			Section{Host: "web", ProxyCommand: "ssh -W \"%h:%p\"  jump"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupConfig(t, tt.config)
+			if got := getSshEntry(tt.host, tt.user); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getSshEntry(%q, %q) = %+v, want %+v", tt.host, tt.user, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		user   string // as on the command line
+		want   bool   // whether the Match line applies to host web
+	}{
+		{"all", "Match all", "", true},
+		{"final", "Match final", "", true},
+		{"canonical", "Match canonical", "", false},
+		{"not canonical", "Match !canonical", "", true},
+		{"no criteria", "Match", "", false},
+		{"host", "Match host w*", "", true},
+		{"host list", "Match host db,web", "", true},
+		{"host mismatch", "Match host db", "", false},
+		{"host negated", "Match !host db", "", true},
+		{"host negated pattern", "Match host *,!web", "", false},
+		{"host uses HostName", "Host web\n  HostName web.example.com\nMatch host *.example.com", "", true},
+		{"originalhost ignores HostName", "Host web\n  HostName db\nMatch originalhost web", "", true},
+		{"user from the command line", "Match user bob", "bob", true},
+		{"user from the config", "Host web\n  User alice\nMatch user alice", "", true},
+		{"user defaults to the local user", "Match user me", "", true},
+		{"user mismatch", "Match user alice", "bob", false},
+		{"localuser", "Match localuser me", "bob", true},
+		{"localuser mismatch", "Match localuser bob", "bob", false},
+		{"exec succeeds", "Match exec true", "", true},
+		{"exec fails", "Match exec false", "", false},
+		{"exec negated", "Match !exec false", "", true},
+		{"exec expands tokens", "Match exec \"test %h:%r = web:bob\"", "bob", true},
+		{"criteria are and-ed", "Match host web user alice", "bob", false},
+		{"all criteria hold", "Match host web user bob localuser me", "bob", true},
+		{"missing argument", "Match host", "", false},
+		{"unsupported criterion", "Match tagged x", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupConfig(t, tt.config+"\n  Port 2222\n")
+			got := getSshEntry("web", tt.user).Port == 2222
+			if got != tt.want {
+				t.Errorf("%q applies = %v, want %v", tt.config, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchWarnsOnce(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	setupConfig(t, "Match tagged x\n  User a\nMatch host\n  User b\n")
+	for i := 0; i < 3; i++ {
+		getSshEntry("web", "")
+		getSshEntry("db", "")
+	}
+	out := buf.String()
+	if n := strings.Count(out, "unsupported Match criterion"); n != 1 {
+		t.Errorf("unsupported criterion warned %d times, want 1:\n%s", n, out)
+	}
+	if n := strings.Count(out, "missing argument"); n != 1 {
+		t.Errorf("missing argument warned %d times, want 1:\n%s", n, out)
+	}
+}
+
+func TestInclude(t *testing.T) {
+	dir := t.TempDir()
+	currentUser = &user.User{Username: "me", HomeDir: dir}
+	write := func(name, text string) {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(text), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("conf.d/10-web", "Host web\n  User web10\n  Port 2210\n")
+	write("conf.d/20-web", "Host web\n  User web20\n  HostName web.example.com\n")
+	write("conf.d/skip", "Host web\n  IdentityFile skipped\n")
+	write("db", "Host db\n  User db\n")
+	// relative to the directory of the top config, not of the including file
+	write("conf.d/nested", "Include db\n")
+	write("config", "Host web\n  Include conf.d/??-web\n"+
+		"Host *\n  Include conf.d/nested\n  User default\n")
+
+	configLines = nil
+	defer func() { configLines = nil }()
+	if !parseSshConfig(filepath.Join(dir, "config")) {
+		t.Fatal("parseSshConfig failed")
+	}
+
+	want := Section{Host: "web", User: "web10", Port: 2210, Hostname: "web.example.com"}
+	if got := getSshEntry("web", ""); !reflect.DeepEqual(got, want) {
+		t.Errorf("web = %+v, want %+v", got, want)
+	}
+	want = Section{Host: "db", User: "db"}
+	if got := getSshEntry("db", ""); !reflect.DeepEqual(got, want) {
+		t.Errorf("db = %+v, want %+v", got, want)
+	}
+}
+
+func TestIncludeDepth(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	// a config that includes itself stops at the limit
+	setupConfig(t, "Include config\nUser me\n")
+	depth := 0
+	for lines := configLines; len(lines) > 0 && len(lines[0].include) > 0; lines = lines[0].include {
+		depth++
+	}
+	if depth != maxIncludeDepth {
+		t.Errorf("include depth = %d, want %d", depth, maxIncludeDepth)
+	}
+	if !strings.Contains(buf.String(), "too many nested includes") {
+		t.Errorf("no warning about nested includes:\n%s", buf.String())
+	}
+	if got := getSshEntry("web", "").User; got != "me" {
+		t.Errorf("User = %q, want %q", got, "me")
+	}
+}
@@ -30,14 +30,20 @@ import (
 	"bytes"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
@@ -45,6 +51,7 @@ import (
 )
 
 func getpass(prompt string) (pass string, err error) {
+	defer pauseHandshake()()
 
 	tstate, err := terminal.GetState(0)
 	if err != nil {
@@ -83,6 +90,22 @@ func getpass(prompt string) (pass string, err error) {
 	return
 }
 
+// stdinReader is shared by all the prompts, so that input typed ahead or
+// piped in is not lost in the buffer of an earlier one.
+var stdinReader = bufio.NewReader(os.Stdin)
+
+// getline is like getpass, but the answer is echoed.
+func getline(prompt string) (line string, err error) {
+	defer pauseHandshake()()
+	f := bufio.NewWriter(os.Stdout)
+	f.Write([]byte(prompt))
+	f.Flush()
+
+	line, err = stdinReader.ReadString('\n')
+	line = strings.TrimRight(line, "\r\n")
+	return
+}
+
 // ref golang.org/x/crypto/ssh/keys.go#ParseRawPrivateKey.
 func ParsePemBlock(block *pem.Block) (interface{}, error) {
 
@@ -93,6 +116,12 @@ func ParsePemBlock(block *pem.Block) (interface{}, error) {
 		return x509.ParseECPrivateKey(block.Bytes)
 	case "DSA PRIVATE KEY":
 		return ssh.ParseDSAPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "OPENSSH PRIVATE KEY":
+		return ssh.ParseRawPrivateKey(pem.EncodeToMemory(block))
+	case "ENCRYPTED PRIVATE KEY":
+		return nil, fmt.Errorf("rtop: encrypted PKCS#8 keys are not supported, convert it with 'ssh-keygen -p'")
 	default:
 		return nil, fmt.Errorf("rtop: unsupported key type %q", block.Type)
 	}
@@ -100,6 +129,9 @@ func ParsePemBlock(block *pem.Block) (interface{}, error) {
 
 func expandPath(path string) string {
 
+	if path == "~" {
+		return currentUser.HomeDir
+	}
 	if len(path) < 2 || path[:2] != "~/" {
 		return path
 	}
@@ -107,69 +139,336 @@ func expandPath(path string) string {
 	return strings.Replace(path, "~", currentUser.HomeDir, 1)
 }
 
-func addKeyAuth(auths []ssh.AuthMethod, keypath string) []ssh.AuthMethod {
-	if len(keypath) == 0 {
-		return auths
+var defaultIdentityFiles = []string{
+	"~/.ssh/id_ed25519",
+	"~/.ssh/id_ecdsa",
+	"~/.ssh/id_rsa",
+	"~/.ssh/id_dsa",
+}
+
+// getDefaultIdentities returns those of the default identity files that
+// exist, in the order ssh tries them.
+func getDefaultIdentities() (keypaths []string) {
+	for _, keypath := range defaultIdentityFiles {
+		if _, err := os.Stat(expandPath(keypath)); err == nil {
+			keypaths = append(keypaths, keypath)
+		}
+	}
+	return
+}
+
+// keySigner is a signer for a passphrase-protected key whose public half is
+// known. The passphrase is asked for only once the server has accepted the
+// public key, so that keys which are not needed do not cause prompts.
+type keySigner struct {
+	keypath string
+	pub     ssh.PublicKey
+	block   *pem.Block
+	signer  ssh.Signer
+	err     error
+}
+
+func (k *keySigner) PublicKey() ssh.PublicKey {
+	return k.pub
+}
+
+func (k *keySigner) Algorithms() []string {
+	return keyAlgorithms(k.pub.Type())
+}
+
+func (k *keySigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return k.SignWithAlgorithm(rand, data, "")
+}
+
+func (k *keySigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	if k.signer == nil && k.err == nil {
+		k.signer, k.err = decryptKey(k.keypath, k.block)
+	}
+	if k.err != nil {
+		return nil, k.err
+	}
+	if as, ok := k.signer.(ssh.AlgorithmSigner); ok && len(algorithm) > 0 {
+		return as.SignWithAlgorithm(rand, data, algorithm)
+	}
+	return k.signer.Sign(rand, data)
+}
+
+func decryptKey(keypath string, block *pem.Block) (signer ssh.Signer, err error) {
+	var key interface{}
+	prompt := fmt.Sprintf("Enter passphrase for key '%s': ", keypath)
+	for tries := 0; tries < 3; tries++ {
+		var pass string
+		pass, err = getpass(prompt)
+		if err != nil {
+			return
+		}
+		if len(pass) == 0 {
+			return nil, fmt.Errorf("no passphrase given for %s", keypath)
+		}
+		key, err = ssh.ParseRawPrivateKeyWithPassphrase(pem.EncodeToMemory(block), []byte(pass))
+		if err != x509.IncorrectPasswordError {
+			break
+		}
+		log.Printf("bad passphrase for %s", keypath)
 	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", keypath, err)
+	}
+	return ssh.NewSignerFromKey(key)
+}
 
-	keypath = expandPath(keypath)
+func readPublicKey(path string) ssh.PublicKey {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil
+	}
+	return pub
+}
 
+func loadKey(keypath string) (ssh.Signer, error) {
 	// read the file
 	pemBytes, err := ioutil.ReadFile(keypath)
 	if err != nil {
-		log.Print(err)
-		os.Exit(1)
+		return nil, err
 	}
 
-	// get first pem block
-	block, _ := pem.Decode(pemBytes)
+	// get the private key pem block, skipping others like "EC PARAMETERS"
+	var block *pem.Block
+	for rest := pemBytes; ; {
+		block, rest = pem.Decode(rest)
+		if block == nil || strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			break
+		}
+	}
 	if block == nil {
-		log.Printf("no key found in %s", keypath)
-		return auths
+		return nil, fmt.Errorf("no key found in %s", keypath)
 	}
 
 	// handle plain and encrypted keyfiles
-	if x509.IsEncryptedPEMBlock(block) {
-		prompt := fmt.Sprintf("Enter passphrase for key '%s': ", keypath)
-		pass, err := getpass(prompt)
-		if err != nil {
-			return auths
+	var pub ssh.PublicKey
+	if !x509.IsEncryptedPEMBlock(block) {
+		key, err := ParsePemBlock(block)
+		if missing, ok := err.(*ssh.PassphraseMissingError); ok {
+			pub = missing.PublicKey
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %v", keypath, err)
+		} else {
+			return ssh.NewSignerFromKey(key)
 		}
-		block.Bytes, err = x509.DecryptPEMBlock(block, []byte(pass))
-		if err != nil {
-			log.Print(err)
-			return auths
+	}
+	if pub == nil {
+		pub = readPublicKey(keypath + ".pub")
+	}
+	if pub != nil {
+		return &keySigner{keypath: keypath, pub: pub, block: block}, nil
+	}
+	return decryptKey(keypath, block)
+}
+
+// lastAuth describes the auth method that was tried last, which after a
+// successful handshake is the one that worked.
+var lastAuth string
+
+// authSigner wraps a signer to note down where the key came from when the
+// server asks for a signature.
+type authSigner struct {
+	ssh.Signer
+	source string
+}
+
+func (s *authSigner) Algorithms() []string {
+	pub := s.PublicKey()
+	if cert, ok := pub.(*ssh.Certificate); ok {
+		pub = cert.Key
+	}
+	switch signer := s.Signer.(type) {
+	case ssh.MultiAlgorithmSigner:
+		return signer.Algorithms()
+	case ssh.AlgorithmSigner:
+		return keyAlgorithms(pub.Type())
+	}
+	return []string{pub.Type()}
+}
+
+func (s *authSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	lastAuth = "publickey (" + s.source + ")"
+	return s.Signer.Sign(rand, data)
+}
+
+func (s *authSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	lastAuth = "publickey (" + s.source + ")"
+	if as, ok := s.Signer.(ssh.AlgorithmSigner); ok {
+		return as.SignWithAlgorithm(rand, data, algorithm)
+	}
+	return s.Signer.Sign(rand, data)
+}
+
+// keys loaded so far, so that reconnecting does not ask for passphrases
+// again (nil if the key could not be loaded)
+var loadedKeys = make(map[string]ssh.Signer)
+
+func getKeySigners(keypaths []string) (signers []ssh.Signer) {
+	for _, keypath := range keypaths {
+		signer, ok := loadedKeys[keypath]
+		if !ok {
+			var err error
+			if signer, err = loadKey(expandPath(keypath)); err != nil {
+				log.Printf("warning: %v", err)
+				signer = nil
+			}
+			loadedKeys[keypath] = signer
 		}
-		key, err := ParsePemBlock(block)
-		if err != nil {
-			log.Print(err)
-			return auths
+		if signer != nil {
+			signers = append(signers, &authSigner{signer, keypath})
 		}
-		signer, err := ssh.NewSignerFromKey(key)
+	}
+	return
+}
+
+func hasKey(signers []ssh.Signer, key ssh.PublicKey) bool {
+	for _, s := range signers {
+		if bytes.Equal(s.PublicKey().Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	// the ssh agent, dialed once and used for every connection made,
+	// including jump hosts and reconnects
+	agentClient agent.ExtendedAgent
+	agentDialed bool
+)
+
+func getAgent() agent.ExtendedAgent {
+	if agentDialed {
+		return agentClient
+	}
+	agentDialed = true
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if len(sock) == 0 {
+		debugf("no ssh agent (SSH_AUTH_SOCK is not set)")
+		return nil
+	}
+	agconn, err := net.Dial("unix", sock)
+	if err != nil {
+		debugf("ssh agent: %v", err)
+		return nil
+	}
+	agentClient = agent.NewClient(agconn)
+	return agentClient
+}
+
+func loadCertificate(path string) (*ssh.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s: not a certificate", path)
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity && uint64(time.Now().Unix()) >= cert.ValidBefore {
+		return nil, fmt.Errorf("%s: certificate has expired", path)
+	}
+	return cert, nil
+}
+
+// getCertificates loads the certificates from the CertificateFile entries,
+// and the ones found next to the identity files as <keyfile>-cert.pub.
+func getCertificates(certpaths, keypaths []string) (certs []*ssh.Certificate) {
+	for _, certpath := range certpaths {
+		cert, err := loadCertificate(expandPath(certpath))
 		if err != nil {
-			log.Print(err)
-			return auths
+			log.Printf("warning: %v", err)
+			continue
 		}
-		return append(auths, ssh.PublicKeys(signer))
-	} else {
-		signer, err := ssh.ParsePrivateKey(pemBytes)
+		certs = append(certs, cert)
+	}
+	for _, keypath := range keypaths {
+		certpath := expandPath(keypath) + "-cert.pub"
+		if _, err := os.Stat(certpath); err != nil {
+			continue
+		}
+		cert, err := loadCertificate(certpath)
 		if err != nil {
-			log.Print(err)
-			return auths
+			log.Printf("warning: %v", err)
+			continue
 		}
-		return append(auths, ssh.PublicKeys(signer))
+		certs = append(certs, cert)
 	}
+	return
 }
 
-func getAgentAuth() (auth ssh.AuthMethod, ok bool) {
-	if sock := os.Getenv("SSH_AUTH_SOCK"); len(sock) > 0 {
-		if agconn, err := net.Dial("unix", sock); err == nil {
-			ag := agent.NewClient(agconn)
-			auth = ssh.PublicKeysCallback(ag.Signers)
-			ok = true
+func hasCert(certs []*ssh.Certificate, key ssh.PublicKey) bool {
+	for _, cert := range certs {
+		if bytes.Equal(cert.Key.Marshal(), key.Marshal()) {
+			return true
 		}
 	}
-	return
+	return false
+}
+
+// getPublicKeyAuth offers the agent's keys followed by the ones from the
+// identity files, in a single publickey method. Keys that have certificates
+// are offered with each certificate first. With identitiesOnly, only agent
+// keys that match one of the identity files or certificates are used.
+func getPublicKeyAuth(identities []ssh.Signer, certs []*ssh.Certificate,
+	identitiesOnly bool) ssh.AuthMethod {
+	ag := getAgent()
+	return ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		var keys []ssh.Signer
+		if ag != nil {
+			agentSigners, err := ag.Signers()
+			if err != nil {
+				debugf("ssh agent: %v", err)
+			}
+			for _, s := range agentSigners {
+				if identitiesOnly && !hasKey(identities, s.PublicKey()) &&
+					!hasCert(certs, s.PublicKey()) {
+					continue
+				}
+				source := "agent"
+				if k, ok := s.PublicKey().(*agent.Key); ok && len(k.Comment) > 0 {
+					source = "agent: " + k.Comment
+				}
+				keys = append(keys, &authSigner{s, source})
+			}
+		}
+		for _, s := range identities {
+			if !hasKey(keys, s.PublicKey()) {
+				keys = append(keys, s)
+			}
+		}
+
+		var signers []ssh.Signer
+		for _, s := range keys {
+			key := s.(*authSigner)
+			for _, cert := range certs {
+				if !bytes.Equal(cert.Key.Marshal(), key.PublicKey().Marshal()) {
+					continue
+				}
+				certSigner, err := ssh.NewCertSigner(cert, key.Signer)
+				if err != nil {
+					debugf("%s: %v", key.source, err)
+					continue
+				}
+				source := fmt.Sprintf("%s, certificate %q", key.source, cert.KeyId)
+				signers = append(signers, &authSigner{certSigner, source})
+			}
+			signers = append(signers, key)
+		}
+		return signers, nil
+	})
 }
 
 func addPasswordAuth(user, addr string, auths []ssh.AuthMethod) []ssh.AuthMethod {
@@ -182,67 +481,434 @@ func addPasswordAuth(user, addr string, auths []ssh.AuthMethod) []ssh.AuthMethod
 	}
 	prompt := fmt.Sprintf("%s@%s's password: ", user, host)
 	passwordCallback := func() (string, error) {
+		lastAuth = "password"
 		return getpass(prompt)
 	}
 	return append(auths, ssh.PasswordCallback(passwordCallback))
 }
 
-func tryAgentConnect(user, addr string) (client *ssh.Client) {
-	if auth, ok := getAgentAuth(); ok {
-		config := &ssh.ClientConfig{
-			User: user,
-			Auth: []ssh.AuthMethod{auth},
+// addKeyboardInteractiveAuth answers the server's challenges, like the
+// password and one-time code prompts of PAM with 2FA.
+func addKeyboardInteractiveAuth(auths []ssh.AuthMethod) []ssh.AuthMethod {
+	if terminal.IsTerminal(0) == false {
+		return auths
+	}
+	challenge := func(name, instruction string, questions []string, echos []bool) (answers []string, err error) {
+		lastAuth = "keyboard-interactive"
+		if len(name) > 0 {
+			fmt.Println(name)
+		}
+		if len(instruction) > 0 {
+			fmt.Println(instruction)
+		}
+		answers = make([]string, len(questions))
+		for i, q := range questions {
+			if echos[i] {
+				answers[i], err = getline(q)
+			} else {
+				answers[i], err = getpass(q)
+			}
+			if err != nil {
+				return nil, err
+			}
 		}
-		client, _ = ssh.Dial("tcp", addr, config)
+		return
 	}
+	return append(auths, ssh.KeyboardInteractive(challenge))
+}
 
+const defaultPreferredAuthentications = "publickey,keyboard-interactive,password"
+
+// getAuthMethods returns the auth methods to offer, in the order given by
+// PreferredAuthentications.
+func getAuthMethods(s *Section, addr string) (auths []ssh.AuthMethod) {
+	preferred := s.PreferredAuthentications
+	if len(preferred) == 0 {
+		preferred = defaultPreferredAuthentications
+	}
+	for _, method := range strings.Split(preferred, ",") {
+		switch strings.TrimSpace(method) {
+		case "publickey":
+			identities := getKeySigners(s.IdentityFile)
+			certs := getCertificates(s.CertificateFile, s.IdentityFile)
+			identitiesOnly := strings.ToLower(s.IdentitiesOnly) == "yes"
+			auths = append(auths, getPublicKeyAuth(identities, certs, identitiesOnly))
+		case "keyboard-interactive":
+			auths = addKeyboardInteractiveAuth(auths)
+		case "password":
+			auths = addPasswordAuth(s.User, addr, auths)
+		default:
+			debugf("ignoring unsupported auth method %q", method)
+		}
+	}
 	return
 }
 
-func sshConnect(user, addr, keypath string) (client *ssh.Client) {
-	// try connecting via agent first
-	client = tryAgentConnect(user, addr)
-	if client != nil {
+// maxJumpDepth limits how deeply jump hosts can themselves have jump hosts,
+// to catch loops in the ssh config.
+const maxJumpDepth = 8
+
+// getJumpHosts returns the settings for each of the jump hosts in s, in the
+// order they are to be connected through.
+func getJumpHosts(s *Section) (hops []Section, err error) {
+	if len(s.ProxyJump) == 0 || strings.ToLower(s.ProxyJump) == "none" {
 		return
 	}
+	for _, spec := range strings.Split(s.ProxyJump, ",") {
+		user, host, port, err := parseHostSpec(strings.TrimSpace(spec))
+		if err != nil {
+			return nil, fmt.Errorf("ProxyJump: %v", err)
+		}
+		hops = append(hops, getHostConfig(host, port, user, nil))
+	}
+	return
+}
+
+// Unlike ssh, rtop does not wait for as long as the OS does on a host that
+// does not answer: reconnects would block the refreshes all that time.
+const defaultConnectTimeout = 15 * time.Second
+
+// the connection whose handshake is under way, if any, and its timeout
+var (
+	handshakeConn    net.Conn
+	handshakeTimeout time.Duration
+)
+
+// startHandshake sets a deadline for the handshake on conn. Tunneled
+// connections do not support deadlines, but the keepalives on the
+// connection they go through cover for that.
+func startHandshake(conn net.Conn, timeout time.Duration) {
+	handshakeConn, handshakeTimeout = conn, timeout
+	conn.SetDeadline(time.Now().Add(timeout))
+}
+
+func endHandshake() {
+	if handshakeConn != nil {
+		handshakeConn.SetDeadline(time.Time{})
+		handshakeConn = nil
+	}
+}
 
-	// if that failed try with the key and password methods
-	auths := make([]ssh.AuthMethod, 0, 2)
-	auths = addKeyAuth(auths, keypath)
-	auths = addPasswordAuth(user, addr, auths)
+// pauseHandshake lifts the deadline of the handshake under way while the
+// user is asked something, and returns the function that sets it again.
+func pauseHandshake() (resume func()) {
+	conn := handshakeConn
+	if conn == nil {
+		return func() {}
+	}
+	conn.SetDeadline(time.Time{})
+	return func() {
+		conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	}
+}
 
+// sshDial connects and authenticates to the host in s. If via is not nil,
+// the connection is tunneled through it.
+func sshDial(s *Section, via *ssh.Client) (client *ssh.Client, err error) {
+	addr := net.JoinHostPort(s.Hostname, strconv.Itoa(s.Port))
+	hostKeys := newHostKeyChecker(s.StrictHostKeyChecking, s.UserKnownHostsFile)
 	config := &ssh.ClientConfig{
-		User: user,
-		Auth: auths,
-		HostKeyCallback: func(string, net.Addr, ssh.PublicKey) error {
-			return nil
-		},
+		User:              s.User,
+		Auth:              getAuthMethods(s, addr),
+		HostKeyCallback:   hostKeys.check,
+		HostKeyAlgorithms: hostKeys.hostKeyAlgorithms(addr),
+	}
+
+	timeout := defaultConnectTimeout
+	if secs, err := strconv.Atoi(s.ConnectTimeout); err == nil && secs > 0 {
+		timeout = time.Duration(secs) * time.Second
+	}
+
+	var conn net.Conn
+	if via != nil {
+		conn, err = via.Dial("tcp", addr)
+	} else if len(s.ProxyCommand) > 0 && strings.ToLower(s.ProxyCommand) != "none" {
+		conn, err = dialProxyCommand(s)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, timeout)
+	}
+	if err != nil {
+		return
+	}
+	// the handshake gets as long as the connect, plus the time spent at
+	// the prompts
+	startHandshake(conn, timeout)
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	endHandshake()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	debugf("authenticated to %s as %s using %s", addr, s.User, lastAuth)
+
+	client = ssh.NewClient(c, chans, reqs)
+	interval, countMax := getServerAlive(s)
+	if interval > 0 {
+		go keepAlive(client, interval, countMax)
+	}
+	return
+}
+
+// rtop relies on noticing dead connections, so unlike ssh it sends
+// keepalives unless ServerAliveInterval is explicitly set to 0.
+const (
+	defaultServerAliveInterval = 15 * time.Second
+	defaultServerAliveCountMax = 3
+)
+
+func getServerAlive(s *Section) (interval time.Duration, countMax int) {
+	interval, countMax = defaultServerAliveInterval, defaultServerAliveCountMax
+	if secs, err := strconv.Atoi(s.ServerAliveInterval); err == nil && secs >= 0 {
+		interval = time.Duration(secs) * time.Second
+	}
+	if n, err := strconv.Atoi(s.ServerAliveCountMax); err == nil && n > 0 {
+		countMax = n
+	}
+	return
+}
+
+// keepAlive sends a keepalive request every interval, and closes the
+// connection once countMax of them in a row have gone unanswered.
+func keepAlive(client *ssh.Client, interval time.Duration, countMax int) {
+	done := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(done)
+	}()
+
+	var missed int32
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if atomic.LoadInt32(&missed) >= int32(countMax) {
+				debugf("no reply to %d keepalives, closing the connection", countMax)
+				client.Close()
+				return
+			}
+			atomic.AddInt32(&missed, 1)
+			go func() {
+				// any reply will do, even a failure
+				if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+					atomic.StoreInt32(&missed, 0)
+				}
+			}()
+		}
+	}
+}
+
+// sshDialJump connects to the host in s, through its jump hosts if any. The
+// first jump host is reached using its own settings, including any jump
+// hosts of its own; the rest are each tunneled through the one before.
+func sshDialJump(s *Section, depth int) (client *ssh.Client, err error) {
+	hops, err := getJumpHosts(s)
+	if err != nil {
+		return
+	}
+	if len(hops) > 0 && depth >= maxJumpDepth {
+		return nil, fmt.Errorf("too many levels of jump hosts for %s", s.Hostname)
+	}
+
+	var via *ssh.Client
+	for i := range hops {
+		var hop *ssh.Client
+		if i == 0 {
+			hop, err = sshDialJump(&hops[i], depth+1)
+		} else {
+			hop, err = sshDial(&hops[i], via)
+		}
+		if err != nil {
+			if via != nil {
+				via.Close()
+			}
+			return nil, fmt.Errorf("jump host %s: %v", hops[i].Hostname, err)
+		}
+		if via != nil {
+			closeAfter(hop, via)
+		}
+		via = hop
 	}
-	client, err := ssh.Dial("tcp", addr, config)
+
+	client, err = sshDial(s, via)
+	if via != nil {
+		if err != nil {
+			via.Close()
+		} else {
+			closeAfter(client, via)
+		}
+	}
+	return
+}
+
+// closeAfter closes the connection a tunnel runs through once the tunneled
+// client is done, so that a chain of jump hosts is torn down in order.
+func closeAfter(client, via *ssh.Client) {
+	go func() {
+		client.Wait()
+		via.Close()
+	}()
+}
+
+const (
+	minReconnectDelay = 1 * time.Second
+	maxReconnectDelay = 1 * time.Minute
+)
+
+// remote is the connection to the monitored host. When the connection
+// drops, it is re-established with exponential backoff.
+type remote struct {
+	s       *Section
+	mu      sync.Mutex
+	client  *ssh.Client // nil while disconnected
+	err     error       // why the connection was lost or could not be made
+	attempt int         // reconnect attempts since the connection was lost
+	retryAt time.Time   // when the next reconnect attempt is due
+}
+
+// newRemote makes the first connection, and exits if that fails.
+func newRemote(s *Section) *remote {
+	client, err := sshDialJump(s, 0)
 	if err != nil {
 		log.Print(err)
 		os.Exit(1)
 	}
+	r := &remote{s: s}
+	r.setClient(client)
+	return r
+}
 
-	return
+func (r *remote) setClient(client *ssh.Client) {
+	r.mu.Lock()
+	r.client = client
+	r.err = nil
+	r.attempt = 0
+	r.mu.Unlock()
+
+	go func() {
+		err := client.Wait()
+		if err == nil {
+			err = io.EOF
+		}
+		r.mu.Lock()
+		if r.client == client {
+			r.client = nil
+			r.err = err
+			r.retryAt = time.Now()
+		}
+		r.mu.Unlock()
+	}()
+}
+
+// Client returns the connected client, or nil while disconnected.
+func (r *remote) Client() *ssh.Client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.client
+}
+
+// Reconnect tries to connect again, if an attempt is due. It returns the
+// new client, or nil if still disconnected.
+func (r *remote) Reconnect() *ssh.Client {
+	r.mu.Lock()
+	if r.client != nil || time.Now().Before(r.retryAt) {
+		r.mu.Unlock()
+		return r.client
+	}
+	r.attempt++
+	attempt := r.attempt
+	r.mu.Unlock()
+
+	debugf("reconnecting to %s (attempt %d)", r.s.Hostname, attempt)
+	client, err := sshDialJump(r.s, 0)
+	if err != nil {
+		delay := minReconnectDelay << uint(attempt-1)
+		if delay > maxReconnectDelay || delay <= 0 {
+			delay = maxReconnectDelay
+		}
+		r.mu.Lock()
+		r.err = err
+		r.retryAt = time.Now().Add(delay)
+		r.mu.Unlock()
+		return nil
+	}
+	r.setClient(client)
+	return client
 }
 
+// Status describes the state of a lost connection.
+func (r *remote) Status() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.client != nil {
+		return "connected"
+	}
+	status := fmt.Sprintf("disconnected from %s: %v", r.s.Hostname, r.err)
+	if wait := time.Until(r.retryAt); wait > 0 {
+		return fmt.Sprintf("%s\nnext reconnect attempt in %v (attempt %d so far)",
+			status, (wait + time.Second - 1).Truncate(time.Second), r.attempt)
+	}
+	return fmt.Sprintf("%s\nreconnecting (attempt %d)...", status, r.attempt+1)
+}
+
+// lockedBuffer is a bytes.Buffer that can be read while the session is
+// still writing to it.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// errTimeout is returned by runCommand for commands that did not complete
+// within commandTimeout.
+var errTimeout = errors.New("command timed out")
+
+// how long a remote command may run, set from the refresh interval
+var commandTimeout = DEFAULT_REFRESH * time.Second
+
 func runCommand(client *ssh.Client, command string) (stdout string, err error) {
 	session, err := client.NewSession()
 	if err != nil {
 		//log.Print(err)
+		if _, ok := err.(*ssh.OpenChannelError); !ok {
+			// the connection is broken, close it so that it gets noticed
+			client.Close()
+		}
 		return
 	}
 	defer session.Close()
 
-	var buf bytes.Buffer
+	var buf lockedBuffer
 	session.Stdout = &buf
-	err = session.Run(command)
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Run(command)
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(commandTimeout):
+		// closing the session makes Run return; whatever was output so far
+		// is still returned
+		return buf.String(), errTimeout
+	}
 	if err != nil {
 		//log.Print(err)
 		return
 	}
-	stdout = string(buf.Bytes())
+	stdout = buf.String()
 
 	return
 }
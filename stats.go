@@ -27,6 +27,8 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"fmt"
 	"golang.org/x/crypto/ssh"
 	"strconv"
 	"strings"
@@ -39,74 +41,317 @@ type FSInfo struct {
 	Free       uint64
 }
 
+type DiskIOInfo struct {
+	Device     string
+	ReadBytes  float64 // bytes/s
+	WriteBytes float64
+	ReadIOPS   float64
+	WriteIOPS  float64
+	Await      float64 // ms per I/O
+	Util       float64 // % of the time busy
+}
+
+// PSILine is a line of /proc/pressure/*: the share of time some (or all)
+// tasks were stalled, over the last 10s, 60s and 300s, and the total stall
+// time since boot.
+type PSILine struct {
+	Avg10  float64 // %
+	Avg60  float64
+	Avg300 float64
+	Total  time.Duration
+}
+
+type PSIInfo struct {
+	Some    PSILine
+	Full    PSILine
+	HasFull bool // no full line for cpu before Linux 5.13
+}
+
 type NetIntfInfo struct {
 	IPv4 string
 	IPv6 string
-	Rx   uint64
+	Rx   uint64 // bytes since boot
 	Tx   uint64
+
+	RxRate, TxRate             float64 // bytes/s
+	RxPacketRate, TxPacketRate float64 // packets/s
+
+	RxErrs, RxDrop, RxFifo, RxFrame            uint64
+	TxErrs, TxDrop, TxFifo, TxColls, TxCarrier uint64
 }
 
 type cpuRaw struct {
-	User    uint64 // time spent in user mode
-	Nice    uint64 // time spent in user mode with low priority (nice)
-	System  uint64 // time spent in system mode
-	Idle    uint64 // time spent in the idle task
-	Iowait  uint64 // time spent waiting for I/O to complete (since Linux 2.5.41)
-	Irq     uint64 // time spent servicing  interrupts  (since  2.6.0-test4)
-	SoftIrq uint64 // time spent servicing softirqs (since 2.6.0-test4)
-	Steal   uint64 // time spent in other OSes when running in a virtualized environment
-	Guest   uint64 // time spent running a virtual CPU for guest operating systems under the control of the Linux kernel.
-	Total   uint64 // total of all time fields
+	User      uint64 // time spent in user mode
+	Nice      uint64 // time spent in user mode with low priority (nice)
+	System    uint64 // time spent in system mode
+	Idle      uint64 // time spent in the idle task
+	Iowait    uint64 // time spent waiting for I/O to complete (since Linux 2.5.41)
+	Irq       uint64 // time spent servicing  interrupts  (since  2.6.0-test4)
+	SoftIrq   uint64 // time spent servicing softirqs (since 2.6.0-test4)
+	Steal     uint64 // time spent in other OSes when running in a virtualized environment
+	Guest     uint64 // time spent running a virtual CPU for guest operating systems under the control of the Linux kernel.
+	GuestNice uint64 // time spent running a niced guest (since Linux 2.6.33)
+	Total     uint64 // total of the time fields, less the guest ones
 }
 
 type CPUInfo struct {
-	User    float32
-	Nice    float32
-	System  float32
-	Idle    float32
-	Iowait  float32
-	Irq     float32
-	SoftIrq float32
-	Steal   float32
-	Guest   float32
+	User      float32
+	Nice      float32
+	System    float32
+	Idle      float32
+	Iowait    float32
+	Irq       float32
+	SoftIrq   float32
+	Steal     float32
+	Guest     float32
+	GuestNice float32
+}
+
+type CoreInfo struct {
+	Name string // cpu0, cpu1 ...
+	CPUInfo
 }
 
 type Stats struct {
-	Uptime       time.Duration
-	Hostname     string
-	Load1        string
-	Load5        string
-	Load10       string
-	RunningProcs string
-	TotalProcs   string
-	MemTotal     uint64
-	MemFree      uint64
-	MemBuffers   uint64
-	MemCached    uint64
-	SwapTotal    uint64
-	SwapFree     uint64
-	FSInfos      []FSInfo
-	NetIntf      map[string]NetIntfInfo
-	CPU          CPUInfo // or []CPUInfo to get all the cpu-core's stats?
+	Uptime        time.Duration
+	Hostname      string
+	Load1         string
+	Load5         string
+	Load10        string
+	Pressure      map[string]PSIInfo // cpu, memory, io; empty without PSI
+	RunningProcs  string
+	TotalProcs    string
+	MemTotal      uint64
+	MemFree       uint64
+	MemBuffers    uint64
+	MemCached     uint64
+	MemAvailable  uint64
+	MemShmem      uint64
+	MemSlab       uint64
+	SReclaimable  uint64
+	MemDirty      uint64
+	MemWriteback  uint64
+	CommittedAS   uint64
+	CommitLimit   uint64
+	HugePages     uint64 // HugePages_Total
+	HugePagesFree uint64
+	HugePageSize  uint64
+	SwapTotal     uint64
+	SwapFree      uint64
+	FSInfos       []FSInfo
+	DiskIO        []DiskIOInfo
+	NetIntf       map[string]NetIntfInfo
+	CPU           CPUInfo
+	Cores         []CoreInfo
+	Procs         []ProcInfo
+	Cgroups       []CgroupInfo
+	Container     *ContainerInfo // nil unless the remote is a container
+	TCPStates     map[string]int // by state, IPv4 and IPv6 together
+	UDPSockets    int
+	Listening     []ListenInfo
+	NetCounters   []NetCounter
+	Systemd       bool
+	FailedUnits   []UnitInfo
+	WatchedUnits  []UnitInfo
+	Stale         []string // collectors whose values are from an earlier refresh
+	StaleErr      error    // why they are, when it is not a timeout
 }
 
-func getAllStats(client *ssh.Client, stats *Stats) {
-	getUptime(client, stats)
-	getHostname(client, stats)
-	getLoad(client, stats)
-	getMemInfo(client, stats)
-	getFSInfo(client, stats)
-	getInterfaces(client, stats)
-	getInterfaceInfo(client, stats)
-	getCPU(client, stats)
+// A collector fills in some of the fields of Stats by parsing the output of
+// a remote command. When the output does not arrive in time, keep copies
+// those fields from the previous refresh.
+type collector struct {
+	name    string
+	command string
+	parse   func(out string, stats *Stats) error
+	keep    func(stats, prev *Stats)
+}
+
+var collectors = []collector{
+	{"uptime", "/bin/cat /proc/uptime", parseUptime, func(stats, prev *Stats) {
+		stats.Uptime = prev.Uptime
+	}},
+	{"hostname", "/bin/hostname -f", parseHostname, func(stats, prev *Stats) {
+		stats.Hostname = prev.Hostname
+	}},
+	{"load", "/bin/cat /proc/loadavg", parseLoad, func(stats, prev *Stats) {
+		stats.Load1, stats.Load5, stats.Load10 = prev.Load1, prev.Load5, prev.Load10
+		stats.RunningProcs, stats.TotalProcs = prev.RunningProcs, prev.TotalProcs
+	}},
+	{"pressure", "grep -H . /proc/pressure/cpu /proc/pressure/memory /proc/pressure/io",
+		parsePressure, func(stats, prev *Stats) {
+			stats.Pressure = prev.Pressure
+		}},
+	{"memory", "/bin/cat /proc/meminfo", parseMemInfo, func(stats, prev *Stats) {
+		stats.MemTotal, stats.MemFree = prev.MemTotal, prev.MemFree
+		stats.MemBuffers, stats.MemCached = prev.MemBuffers, prev.MemCached
+		stats.MemAvailable, stats.MemShmem = prev.MemAvailable, prev.MemShmem
+		stats.MemSlab, stats.SReclaimable = prev.MemSlab, prev.SReclaimable
+		stats.MemDirty, stats.MemWriteback = prev.MemDirty, prev.MemWriteback
+		stats.CommittedAS, stats.CommitLimit = prev.CommittedAS, prev.CommitLimit
+		stats.HugePages, stats.HugePagesFree = prev.HugePages, prev.HugePagesFree
+		stats.HugePageSize = prev.HugePageSize
+		stats.SwapTotal, stats.SwapFree = prev.SwapTotal, prev.SwapFree
+	}},
+	{"filesystems", "/bin/df -B1", parseFSInfo, func(stats, prev *Stats) {
+		stats.FSInfos = prev.FSInfos
+	}},
+	{"diskstats", "/bin/cat /proc/diskstats", parseDiskStats, func(stats, prev *Stats) {
+		stats.DiskIO = prev.DiskIO
+	}},
+	{"interfaces", "/bin/ip -o addr || /sbin/ip -o addr", parseInterfaces, func(stats, prev *Stats) {
+		stats.NetIntf = make(map[string]NetIntfInfo)
+		for intf, info := range prev.NetIntf {
+			stats.NetIntf[intf] = NetIntfInfo{IPv4: info.IPv4, IPv6: info.IPv6}
+		}
+	}},
+	{"network", "/bin/cat /proc/net/dev", parseInterfaceInfo, func(stats, prev *Stats) {
+		for intf, info := range stats.NetIntf {
+			if pre, ok := prev.NetIntf[intf]; ok {
+				pre.IPv4, pre.IPv6 = info.IPv4, info.IPv6
+				stats.NetIntf[intf] = pre
+			}
+		}
+	}},
+	{"sockets", socketsCommand, parseSockets, func(stats, prev *Stats) {
+		stats.TCPStates, stats.UDPSockets = prev.TCPStates, prev.UDPSockets
+		stats.Listening = prev.Listening
+	}},
+	{"netcounters", "/bin/cat /proc/net/snmp /proc/net/netstat", parseNetCounters, func(stats, prev *Stats) {
+		stats.NetCounters = prev.NetCounters
+	}},
+	{"cpu", "/bin/cat /proc/stat", parseCPU, func(stats, prev *Stats) {
+		stats.CPU = prev.CPU
+		stats.Cores = prev.Cores
+	}},
+	// after memory and cpu, whose stats it makes the container's
+	{"container", containerCommand, parseContainer, func(stats, prev *Stats) {
+		stats.Container = prev.Container
+		applyContainerLimits(stats)
+	}},
+	{"users", "/bin/cat /etc/passwd", parseUsers, func(stats, prev *Stats) {}},
+	{"processes", procsCommand, parseProcs, func(stats, prev *Stats) {
+		stats.Procs = prev.Procs
+	}},
+	{"cgroups", cgroupsCommand, parseCgroups, func(stats, prev *Stats) {
+		stats.Cgroups = prev.Cgroups
+	}},
+	// the units to watch are added by watchServices
+	{"services", servicesCommand(nil), parseServices, func(stats, prev *Stats) {
+		stats.Systemd = prev.Systemd
+		stats.FailedUnits, stats.WatchedUnits = prev.FailedUnits, prev.WatchedUnits
+	}},
+}
+
+// sectionMarker starts each section of the output of the collect script,
+// followed by the name of the collector. A marker with no name ends the
+// last section.
+const sectionMarker = "--rtop-section-- "
+
+// timeoutMarker follows a section whose command was killed for taking too
+// long, with the name of the collector.
+const timeoutMarker = "--rtop-timeout-- "
+
+// sectionTimeout is how long, in whole seconds, each command of the collect
+// script may run: half of commandTimeout, so that one stuck command (df on
+// a hung NFS mount, say) still leaves the others time to run.
+func sectionTimeout() int {
+	secs := int((commandTimeout/2 + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	return secs
+}
+
+// collectScript runs the commands of all the collectors one after the
+// other, so that all the stats can be had in one go. Each command runs in
+// the background, in a process group of its own, with a watchdog that kills
+// the whole group after sectionTimeout, so that nothing it started can
+// write into the sections after it. The script does not wait any longer
+// for it than that. The commands get no stdin, which is the loop's when
+// streaming. It is all on one line, see shScript.
+func collectScript() string {
+	var script bytes.Buffer
+	// without setsid the command alone is killed, not what it started
+	script.WriteString("command -v setsid >/dev/null || setsid() { \"$@\"; }; ")
+	for _, c := range collectors {
+		fmt.Fprintf(&script, "echo '%s%s'; setsid sh -c %s </dev/null 2>/dev/null & p=$!; "+
+			"setsid sh -c 'sleep %d; kill -9 -$1 || kill -9 $1' - $p >/dev/null 2>&1 & w=$!; "+
+			"wait $p; [ $? -eq 137 ] && echo '%s%s'; kill -- -$w 2>/dev/null || kill $w 2>/dev/null; ",
+			sectionMarker, c.name, shellQuote(c.command),
+			sectionTimeout(),
+			timeoutMarker, c.name)
+	}
+	fmt.Fprintf(&script, "echo '%s'; ", sectionMarker)
+	return script.String()
+}
+
+// shellQuote quotes s as a single word for sh.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
 }
 
-func getUptime(client *ssh.Client, stats *Stats) (err error) {
-	uptime, err := runCommand(client, "/bin/cat /proc/uptime")
-	if err != nil {
+// splitSections splits the output of the collect script by collector name.
+// Sections that were cut short are left out, and those whose command was
+// killed are in timedOut.
+func splitSections(out string) (sections map[string]string, timedOut map[string]bool) {
+	sections = make(map[string]string)
+	timedOut = make(map[string]bool)
+	var name string
+	var section strings.Builder
+	in := false
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, sectionMarker) {
+			if in {
+				sections[name] = section.String()
+			}
+			name = line[len(sectionMarker):]
+			section.Reset()
+			in = len(name) > 0
+		} else if strings.HasPrefix(line, timeoutMarker) {
+			timedOut[line[len(timeoutMarker):]] = true
+		} else if in {
+			section.WriteString(line)
+			section.WriteByte('\n')
+		}
+	}
+	return
+}
+
+// the stats that were fetched last time round
+var lastStats Stats
+
+func getAllStats(client *ssh.Client, stats *Stats) {
+	out, err := collect(client)
+	if err != nil && err != errTimeout {
+		// nothing new at all, show the last stats again rather than zeros
+		debugf("collect: %v", err)
+		for _, c := range collectors {
+			c.keep(stats, &lastStats)
+			stats.Stale = append(stats.Stale, c.name)
+		}
+		stats.StaleErr = err
 		return
 	}
+	sections, timedOut := splitSections(out)
+	for _, c := range collectors {
+		section, ok := sections[c.name]
+		if !ok || timedOut[c.name] {
+			if err == errTimeout || timedOut[c.name] {
+				debugf("%s: %v", c.name, errTimeout)
+				c.keep(stats, &lastStats)
+				stats.Stale = append(stats.Stale, c.name)
+			}
+			continue
+		}
+		c.parse(section, stats)
+	}
+	lastStats = *stats
+}
 
+func parseUptime(uptime string, stats *Stats) (err error) {
 	parts := strings.Fields(uptime)
 	if len(parts) == 2 {
 		var upsecs float64
@@ -120,22 +365,12 @@ func getUptime(client *ssh.Client, stats *Stats) (err error) {
 	return
 }
 
-func getHostname(client *ssh.Client, stats *Stats) (err error) {
-	hostname, err := runCommand(client, "/bin/hostname -f")
-	if err != nil {
-		return
-	}
-
+func parseHostname(hostname string, stats *Stats) (err error) {
 	stats.Hostname = strings.TrimSpace(hostname)
 	return
 }
 
-func getLoad(client *ssh.Client, stats *Stats) (err error) {
-	line, err := runCommand(client, "/bin/cat /proc/loadavg")
-	if err != nil {
-		return
-	}
-
+func parseLoad(line string, stats *Stats) (err error) {
 	parts := strings.Fields(line)
 	if len(parts) == 5 {
 		stats.Load1 = parts[0]
@@ -152,31 +387,103 @@ func getLoad(client *ssh.Client, stats *Stats) (err error) {
 	return
 }
 
-func getMemInfo(client *ssh.Client, stats *Stats) (err error) {
-	lines, err := runCommand(client, "/bin/cat /proc/meminfo")
-	if err != nil {
-		return
+func parsePressure(lines string, stats *Stats) (err error) {
+	scanner := bufio.NewScanner(strings.NewReader(lines))
+	for scanner.Scan() {
+		// /proc/pressure/io:some avg10=0.00 avg60=0.00 avg300=0.00 total=0
+		line := strings.TrimPrefix(scanner.Text(), "/proc/pressure/")
+		i := strings.Index(line, ":")
+		if i == -1 {
+			continue
+		}
+		resource := line[:i]
+		parts := strings.Fields(line[i+1:])
+		if len(parts) != 5 {
+			continue
+		}
+		var psi PSILine
+		for _, part := range parts[1:] {
+			kv := strings.SplitN(part, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "avg10":
+				psi.Avg10, _ = strconv.ParseFloat(kv[1], 64)
+			case "avg60":
+				psi.Avg60, _ = strconv.ParseFloat(kv[1], 64)
+			case "avg300":
+				psi.Avg300, _ = strconv.ParseFloat(kv[1], 64)
+			case "total":
+				usecs, _ := strconv.ParseUint(kv[1], 10, 64)
+				psi.Total = time.Duration(usecs) * time.Microsecond
+			}
+		}
+
+		if stats.Pressure == nil {
+			stats.Pressure = make(map[string]PSIInfo)
+		}
+		info := stats.Pressure[resource]
+		switch parts[0] {
+		case "some":
+			info.Some = psi
+		case "full":
+			info.Full = psi
+			info.HasFull = true
+		}
+		stats.Pressure[resource] = info
 	}
 
+	return
+}
+
+func parseMemInfo(lines string, stats *Stats) (err error) {
+	available := false
 	scanner := bufio.NewScanner(strings.NewReader(lines))
 	for scanner.Scan() {
 		line := scanner.Text()
 		parts := strings.Fields(line)
-		if len(parts) == 3 {
+		// the HugePages_ counts have no unit
+		if len(parts) == 2 || (len(parts) == 3 && parts[2] == "kB") {
 			val, err := strconv.ParseUint(parts[1], 10, 64)
 			if err != nil {
 				continue
 			}
-			val *= 1024
+			if len(parts) == 3 {
+				val *= 1024
+			}
 			switch parts[0] {
 			case "MemTotal:":
 				stats.MemTotal = val
 			case "MemFree:":
 				stats.MemFree = val
+			case "MemAvailable:":
+				stats.MemAvailable = val
+				available = true
 			case "Buffers:":
 				stats.MemBuffers = val
 			case "Cached:":
 				stats.MemCached = val
+			case "Shmem:":
+				stats.MemShmem = val
+			case "Slab:":
+				stats.MemSlab = val
+			case "SReclaimable:":
+				stats.SReclaimable = val
+			case "Dirty:":
+				stats.MemDirty = val
+			case "Writeback:":
+				stats.MemWriteback = val
+			case "Committed_AS:":
+				stats.CommittedAS = val
+			case "CommitLimit:":
+				stats.CommitLimit = val
+			case "HugePages_Total:":
+				stats.HugePages = val
+			case "HugePages_Free:":
+				stats.HugePagesFree = val
+			case "Hugepagesize:":
+				stats.HugePageSize = val
 			case "SwapTotal:":
 				stats.SwapTotal = val
 			case "SwapFree:":
@@ -184,16 +491,51 @@ func getMemInfo(client *ssh.Client, stats *Stats) (err error) {
 			}
 		}
 	}
+	// kernels before 3.14 do not have MemAvailable; estimate it from the
+	// free and the reclaimable memory
+	if !available {
+		stats.MemAvailable = stats.MemFree + stats.MemCached + stats.SReclaimable + stats.MemBuffers
+		if stats.MemAvailable > stats.MemTotal {
+			stats.MemAvailable = stats.MemFree
+		}
+	}
 
 	return
 }
 
-func getFSInfo(client *ssh.Client, stats *Stats) (err error) {
-	lines, err := runCommand(client, "/bin/df -B1")
-	if err != nil {
-		return
+// memUsage works out used and cached the way procps (free, top) does:
+// reclaimable slab counts as cache, and what is not available is used.
+func memUsage(stats *Stats) (used, cached uint64) {
+	cached = stats.MemCached + stats.SReclaimable
+	if stats.MemAvailable < stats.MemTotal {
+		used = stats.MemTotal - stats.MemAvailable
+	}
+	return
+}
+
+// memPressure sums up how tight memory is, from what is still available
+// and how much swap is in use.
+func memPressure(stats *Stats) string {
+	if stats.MemTotal == 0 {
+		return "unknown"
+	}
+	avail := float64(stats.MemAvailable) / float64(stats.MemTotal) * 100
+	var swapUsed float64
+	if stats.SwapTotal > 0 {
+		swapUsed = float64(stats.SwapTotal-stats.SwapFree) / float64(stats.SwapTotal) * 100
 	}
+	level := "low"
+	if avail < 5 || (avail < 10 && swapUsed > 50) {
+		level = "critical"
+	} else if avail < 10 || swapUsed > 50 {
+		level = "high"
+	} else if avail < 25 {
+		level = "moderate"
+	}
+	return fmt.Sprintf("%s (%.1f%% available, %.1f%% of swap used)", level, avail, swapUsed)
+}
 
+func parseFSInfo(lines string, stats *Stats) (err error) {
 	scanner := bufio.NewScanner(strings.NewReader(lines))
 	flag := 0
 	for scanner.Scan() {
@@ -223,17 +565,81 @@ func getFSInfo(client *ssh.Client, stats *Stats) (err error) {
 	return
 }
 
-func getInterfaces(client *ssh.Client, stats *Stats) (err error) {
-	var lines string
-	lines, err = runCommand(client, "/bin/ip -o addr")
-	if err != nil {
-		// try /sbin/ip
-		lines, err = runCommand(client, "/sbin/ip -o addr")
+type diskRaw struct {
+	Reads        uint64 // reads completed
+	ReadSectors  uint64
+	ReadTicks    uint64 // ms spent reading
+	Writes       uint64 // writes completed
+	WriteSectors uint64
+	WriteTicks   uint64 // ms spent writing
+	IOTicks      uint64 // ms spent doing I/O
+}
+
+// the disk stats that were fetched last time round, and the uptime then
+var (
+	preDisks      = make(map[string]diskRaw)
+	preDiskUptime time.Duration
+)
+
+func parseDiskStats(lines string, stats *Stats) (err error) {
+	nowDisks := make(map[string]diskRaw)
+	elapsed := (stats.Uptime - preDiskUptime).Seconds()
+
+	scanner := bufio.NewScanner(strings.NewReader(lines))
+	for scanner.Scan() {
+		parts := strings.Fields(scanner.Text())
+		if len(parts) < 14 {
+			continue
+		}
+		dev := parts[2]
+		if strings.HasPrefix(dev, "loop") || strings.HasPrefix(dev, "ram") {
+			continue
+		}
+		var vals [11]uint64
+		for i := range vals {
+			if vals[i], err = strconv.ParseUint(parts[3+i], 10, 64); err != nil {
+				break
+			}
+		}
 		if err != nil {
-			return
+			err = nil
+			continue
+		}
+		now := diskRaw{vals[0], vals[2], vals[3], vals[4], vals[6], vals[7], vals[9]}
+		if now.Reads == 0 && now.Writes == 0 {
+			// never used
+			continue
+		}
+		nowDisks[dev] = now
+
+		pre, ok := preDisks[dev]
+		if !ok || elapsed <= 0 || now.Reads < pre.Reads || now.Writes < pre.Writes ||
+			now.IOTicks < pre.IOTicks {
+			continue
 		}
+		info := DiskIOInfo{
+			Device:     dev,
+			ReadBytes:  float64(now.ReadSectors-pre.ReadSectors) * 512 / elapsed,
+			WriteBytes: float64(now.WriteSectors-pre.WriteSectors) * 512 / elapsed,
+			ReadIOPS:   float64(now.Reads-pre.Reads) / elapsed,
+			WriteIOPS:  float64(now.Writes-pre.Writes) / elapsed,
+			Util:       float64(now.IOTicks-pre.IOTicks) / 10 / elapsed,
+		}
+		if ios := now.Reads - pre.Reads + now.Writes - pre.Writes; ios > 0 {
+			info.Await = float64(now.ReadTicks-pre.ReadTicks+now.WriteTicks-pre.WriteTicks) / float64(ios)
+		}
+		if info.Util > 100 {
+			info.Util = 100
+		}
+		stats.DiskIO = append(stats.DiskIO, info)
 	}
 
+	preDisks = nowDisks
+	preDiskUptime = stats.Uptime
+	return
+}
+
+func parseInterfaces(lines string, stats *Stats) (err error) {
 	if stats.NetIntf == nil {
 		stats.NetIntf = make(map[string]NetIntfInfo)
 	}
@@ -267,39 +673,64 @@ func getInterfaces(client *ssh.Client, stats *Stats) (err error) {
 	return
 }
 
-func getInterfaceInfo(client *ssh.Client, stats *Stats) (err error) {
-	lines, err := runCommand(client, "/bin/cat /proc/net/dev")
-	if err != nil {
-		return
-	}
+// the network counters that were fetched last time round, by interface:
+// rx bytes, packets, and tx bytes, packets; and the uptime then
+var (
+	preNet       = make(map[string][4]uint64)
+	preNetUptime time.Duration
+)
 
+func parseInterfaceInfo(lines string, stats *Stats) (err error) {
 	if stats.NetIntf == nil {
 		return
 	} // should have been here already
 
+	nowNet := make(map[string][4]uint64)
+	elapsed := (stats.Uptime - preNetUptime).Seconds()
+
 	scanner := bufio.NewScanner(strings.NewReader(lines))
 	for scanner.Scan() {
 		line := scanner.Text()
-		parts := strings.Fields(line)
-		if len(parts) == 17 {
-			intf := strings.TrimSpace(parts[0])
-			intf = strings.TrimSuffix(intf, ":")
-			if info, ok := stats.NetIntf[intf]; ok {
-				rx, err := strconv.ParseUint(parts[1], 10, 64)
-				if err != nil {
-					continue
-				}
-				tx, err := strconv.ParseUint(parts[9], 10, 64)
-				if err != nil {
-					continue
-				}
-				info.Rx = rx
-				info.Tx = tx
-				stats.NetIntf[intf] = info
+		// the name can run into the first counter
+		i := strings.Index(line, ":")
+		if i == -1 {
+			continue
+		}
+		intf := strings.TrimSpace(line[:i])
+		parts := strings.Fields(line[i+1:])
+		info, ok := stats.NetIntf[intf]
+		if !ok || len(parts) != 16 {
+			continue
+		}
+		var vals [16]uint64
+		for i := range vals {
+			if vals[i], err = strconv.ParseUint(parts[i], 10, 64); err != nil {
+				break
 			}
 		}
+		if err != nil {
+			err = nil
+			continue
+		}
+		info.Rx, info.Tx = vals[0], vals[8]
+		info.RxErrs, info.RxDrop, info.RxFifo, info.RxFrame = vals[2], vals[3], vals[4], vals[5]
+		info.TxErrs, info.TxDrop, info.TxFifo = vals[10], vals[11], vals[12]
+		info.TxColls, info.TxCarrier = vals[13], vals[14]
+
+		now := [4]uint64{vals[0], vals[1], vals[8], vals[9]}
+		nowNet[intf] = now
+		if pre, ok := preNet[intf]; ok && elapsed > 0 &&
+			now[0] >= pre[0] && now[1] >= pre[1] && now[2] >= pre[2] && now[3] >= pre[3] {
+			info.RxRate = float64(now[0]-pre[0]) / elapsed
+			info.RxPacketRate = float64(now[1]-pre[1]) / elapsed
+			info.TxRate = float64(now[2]-pre[2]) / elapsed
+			info.TxPacketRate = float64(now[3]-pre[3]) / elapsed
+		}
+		stats.NetIntf[intf] = info
 	}
 
+	preNet = nowNet
+	preNetUptime = stats.Uptime
 	return
 }
 
@@ -311,7 +742,10 @@ func parseCPUFields(fields []string, stat *cpuRaw) {
 			continue
 		}
 
-		stat.Total += val
+		// guest time is already counted in user and nice
+		if i <= 8 {
+			stat.Total += val
+		}
 		switch i {
 		case 1:
 			stat.User = val
@@ -331,47 +765,78 @@ func parseCPUFields(fields []string, stat *cpuRaw) {
 			stat.Steal = val
 		case 9:
 			stat.Guest = val
+		case 10:
+			stat.GuestNice = val
 		}
 	}
 }
 
-// the CPU stats that were fetched last time round
-var preCPU cpuRaw
+// the CPU stats that were fetched last time round, overall and per core
+var (
+	preCPU   cpuRaw
+	preCores = make(map[string]cpuRaw)
+)
 
-func getCPU(client *ssh.Client, stats *Stats) (err error) {
-	lines, err := runCommand(client, "/bin/cat /proc/stat")
-	if err != nil {
+// cpuUsage works out the percentages from two readings of the counters.
+// ok is false if the counters went backwards overall, as they do when the
+// remote was rebooted or a core was offline in between.
+func cpuUsage(nowCPU, preCPU cpuRaw) (info CPUInfo, ok bool) {
+	if nowCPU.Total <= preCPU.Total {
 		return
 	}
+	total := float32(nowCPU.Total - preCPU.Total)
+	pct := func(now, pre uint64) float32 {
+		// single counters can go backwards too, iowait in particular
+		if now < pre {
+			return 0
+		}
+		return float32(now-pre) / total * 100
+	}
+	info.User = pct(nowCPU.User, preCPU.User)
+	info.Nice = pct(nowCPU.Nice, preCPU.Nice)
+	info.System = pct(nowCPU.System, preCPU.System)
+	info.Idle = pct(nowCPU.Idle, preCPU.Idle)
+	info.Iowait = pct(nowCPU.Iowait, preCPU.Iowait)
+	info.Irq = pct(nowCPU.Irq, preCPU.Irq)
+	info.SoftIrq = pct(nowCPU.SoftIrq, preCPU.SoftIrq)
+	info.Steal = pct(nowCPU.Steal, preCPU.Steal)
+	info.Guest = pct(nowCPU.Guest, preCPU.Guest)
+	info.GuestNice = pct(nowCPU.GuestNice, preCPU.GuestNice)
+	return info, true
+}
 
-	var (
-		nowCPU cpuRaw
-		total  float32
-	)
+func parseCPU(lines string, stats *Stats) (err error) {
+	var nowCPU cpuRaw
+	nowCores := make(map[string]cpuRaw)
 
 	scanner := bufio.NewScanner(strings.NewReader(lines))
 	for scanner.Scan() {
 		line := scanner.Text()
 		fields := strings.Fields(line)
-		if len(fields) > 0 && fields[0] == "cpu" { // changing here if want to get every cpu-core's stats
+		if len(fields) == 0 || !strings.HasPrefix(fields[0], "cpu") {
+			continue
+		}
+		if fields[0] == "cpu" {
 			parseCPUFields(fields, &nowCPU)
-			break
+			continue
+		}
+		// cpuN, in order; cores that are offline are left out
+		var core cpuRaw
+		parseCPUFields(fields, &core)
+		nowCores[fields[0]] = core
+		if pre, ok := preCores[fields[0]]; ok {
+			if usage, ok := cpuUsage(core, pre); ok {
+				stats.Cores = append(stats.Cores, CoreInfo{fields[0], usage})
+			}
 		}
 	}
-	if preCPU.Total == 0 { // having no pre raw cpu data
-		goto END
+	stats.CPU, _ = cpuUsage(nowCPU, preCPU)
+	cpuTicks = 0
+	if nowCPU.Total > preCPU.Total && len(nowCores) > 0 {
+		cpuTicks = float64(nowCPU.Total-preCPU.Total) / float64(len(nowCores))
 	}
 
-	total = float32(nowCPU.Total - preCPU.Total)
-	stats.CPU.User = float32(nowCPU.User-preCPU.User) / total * 100
-	stats.CPU.Nice = float32(nowCPU.Nice-preCPU.Nice) / total * 100
-	stats.CPU.System = float32(nowCPU.System-preCPU.System) / total * 100
-	stats.CPU.Idle = float32(nowCPU.Idle-preCPU.Idle) / total * 100
-	stats.CPU.Iowait = float32(nowCPU.Iowait-preCPU.Iowait) / total * 100
-	stats.CPU.Irq = float32(nowCPU.Irq-preCPU.Irq) / total * 100
-	stats.CPU.SoftIrq = float32(nowCPU.SoftIrq-preCPU.SoftIrq) / total * 100
-	stats.CPU.Guest = float32(nowCPU.Guest-preCPU.Guest) / total * 100
-END:
 	preCPU = nowCPU
+	preCores = nowCores
 	return
 }
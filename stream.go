@@ -0,0 +1,189 @@
+/*
+
+rtop - the remote system monitoring utility
+
+Copyright (c) 2015 RapidLoop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// A stream is a session running the collect script in a loop, once for
+// every line it reads from its stdin. This way a refresh costs a single
+// round-trip and no new session on the remote.
+type stream struct {
+	client  *ssh.Client
+	session *ssh.Session
+	stdin   io.WriteCloser
+	frames  chan string
+	done    chan struct{}
+
+	mu      sync.Mutex
+	partial strings.Builder // the frame being read
+}
+
+var (
+	errStreamEnded = errors.New("collector stream ended")
+	errNoStream    = errors.New("remote shell cannot run the collector loop")
+)
+
+func streamScript() string {
+	return shScript("while read -r _; do " + collectScript() + "done")
+}
+
+// shScript runs script with sh whatever the login shell of the remote user
+// is, csh and fish included. The script must be on a single line for csh.
+func shScript(script string) string {
+	return "exec sh -c " + shellQuote(script)
+}
+
+func startStream(client *ssh.Client) (st *stream, err error) {
+	session, err := client.NewSession()
+	if err != nil {
+		if _, ok := err.(*ssh.OpenChannelError); !ok {
+			client.Close()
+		}
+		return
+	}
+	st = &stream{
+		client:  client,
+		session: session,
+		frames:  make(chan string, 1),
+		done:    make(chan struct{}),
+	}
+	var stdout io.Reader
+	if st.stdin, err = session.StdinPipe(); err == nil {
+		if stdout, err = session.StdoutPipe(); err == nil {
+			err = session.Start(streamScript())
+		}
+	}
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	go st.read(stdout)
+	return
+}
+
+// read splits the output of the loop into frames, each ending with the end
+// marker of the collect script.
+func (st *stream) read(stdout io.Reader) {
+	defer close(st.done)
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		st.mu.Lock()
+		st.partial.WriteString(line)
+		st.partial.WriteByte('\n')
+		var frame string
+		if line == sectionMarker {
+			frame = st.partial.String()
+			st.partial.Reset()
+		}
+		st.mu.Unlock()
+		if len(frame) > 0 {
+			st.frames <- frame
+		}
+	}
+}
+
+// next asks for a frame and waits for it. On timeout, the part of the frame
+// that did arrive is returned.
+func (st *stream) next() (frame string, err error) {
+	if _, err = io.WriteString(st.stdin, "\n"); err != nil {
+		return "", errStreamEnded
+	}
+	select {
+	case frame = <-st.frames:
+	case <-st.done:
+		err = errStreamEnded
+	case <-time.After(commandTimeout):
+		st.mu.Lock()
+		frame = st.partial.String()
+		st.mu.Unlock()
+		err = errTimeout
+	}
+	return
+}
+
+func (st *stream) close() {
+	st.session.Close()
+}
+
+var (
+	curStream *stream
+	// the connection on which the remote failed to run the loop, over which
+	// the collect script is run in a new session every time instead; the
+	// loop is tried again after a reconnect
+	noStream *ssh.Client
+)
+
+// collect runs the collect script and returns its output.
+func collect(client *ssh.Client) (out string, err error) {
+	if noStream != client {
+		out, err = collectStream(client)
+		if err != errNoStream {
+			return
+		}
+		debugf("%v, polling instead", err)
+		noStream = client
+	}
+	return runCommand(client, shScript(collectScript()))
+}
+
+func collectStream(client *ssh.Client) (out string, err error) {
+	if curStream != nil && curStream.client != client {
+		// reconnected since
+		curStream.close()
+		curStream = nil
+	}
+	fresh := curStream == nil
+	if fresh {
+		if curStream, err = startStream(client); err != nil {
+			return
+		}
+	}
+	out, err = curStream.next()
+	if err != nil {
+		// a shell that cannot run the loop exits with a status, whereas
+		// a connection that drops takes the session down without one
+		if err == errStreamEnded && fresh {
+			if _, ok := curStream.session.Wait().(*ssh.ExitError); ok {
+				err = errNoStream
+			}
+		}
+		// out of step with the remote now, start over next time
+		curStream.close()
+		curStream = nil
+	}
+	return
+}